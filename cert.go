@@ -0,0 +1,194 @@
+package sdtl
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// Version 1 had no serial; it is refused rather than misread
+	certVersion   = 2
+	certMaxTags   = 8
+	certMaxTagLen = 32
+	// version, serial, ip, not before, not after, key length, tag count
+	certMinSize = 1 + 8 + 16 + 8 + 8 + 1 + 1
+)
+
+// Certificate binds a host public key to an overlay address for a period
+// of time. A server that trusts the CA that signed it accepts the host
+// without a HostConfig entry. Tags are free-form labels for policy, and the
+// serial is what a revocation list names.
+//
+// On the wire it is compact, not X.509: version, serial, IP, not before and
+// not after as Unix seconds, the PKIX public key and the tags, each prefixed
+// with its length in one byte, then the CA signature.
+type Certificate struct {
+	Serial    uint64
+	PublicKey crypto.PublicKey
+	IP        net.IP
+	NotBefore time.Time
+	NotAfter  time.Time
+	Tags      []string
+}
+
+func (c *Certificate) marshal() ([]byte, error) {
+	key, err := x509.MarshalPKIXPublicKey(c.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if KeyType(c.PublicKey) == "" || len(key) > 0xff {
+		return nil, fmt.Errorf("unsupported key type %T", c.PublicKey)
+	}
+	ip := c.IP.To16()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address")
+	}
+	if len(c.Tags) > certMaxTags {
+		return nil, fmt.Errorf("too many tags")
+	}
+	buf := make([]byte, 0, certMinSize+len(key))
+	buf = append(buf, certVersion)
+	buf = binary.BigEndian.AppendUint64(buf, c.Serial)
+	buf = append(buf, ip...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(c.NotBefore.Unix()))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(c.NotAfter.Unix()))
+	buf = append(buf, byte(len(key)))
+	buf = append(buf, key...)
+	buf = append(buf, byte(len(c.Tags)))
+	for _, tag := range c.Tags {
+		if len(tag) == 0 || len(tag) > certMaxTagLen {
+			return nil, fmt.Errorf("invalid tag: %q", tag)
+		}
+		buf = append(buf, byte(len(tag)))
+		buf = append(buf, tag...)
+	}
+	return buf, nil
+}
+
+// IssueCertificate signs c with the CA key and returns it in wire form. A
+// zero serial is replaced with a random one.
+func IssueCertificate(ca crypto.Signer, c *Certificate) ([]byte, error) {
+	if !c.NotAfter.After(c.NotBefore) {
+		return nil, fmt.Errorf("empty validity window")
+	}
+	for c.Serial == 0 {
+		var serial [8]byte
+		if _, err := rand.Read(serial[:]); err != nil {
+			return nil, err
+		}
+		c.Serial = binary.BigEndian.Uint64(serial[:])
+	}
+	buf, err := c.marshal()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signMessage(ca, buf)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, sig...), nil
+}
+
+// parseCertificate decodes a certificate without checking it, and returns
+// the signed part and the signature apart.
+func parseCertificate(raw []byte) (*Certificate, []byte, []byte, error) {
+	var c Certificate
+	if len(raw) > 0 && raw[0] != certVersion {
+		return nil, nil, nil, fmt.Errorf("unsupported certificate version %d, it must be issued again", raw[0])
+	}
+	if len(raw) < certMinSize {
+		return nil, nil, nil, fmt.Errorf("invalid certificate")
+	}
+	c.Serial = binary.BigEndian.Uint64(raw[1:9])
+	c.IP = extractIP(raw[9:])
+	c.NotBefore = time.Unix(int64(binary.BigEndian.Uint64(raw[25:33])), 0)
+	c.NotAfter = time.Unix(int64(binary.BigEndian.Uint64(raw[33:41])), 0)
+	off := 41
+	n := int(raw[off])
+	off++
+	if len(raw) < off+n+1 {
+		return nil, nil, nil, fmt.Errorf("invalid certificate key")
+	}
+	key, err := x509.ParsePKIXPublicKey(raw[off : off+n])
+	if err != nil || KeyType(key) == "" {
+		return nil, nil, nil, fmt.Errorf("invalid certificate key")
+	}
+	c.PublicKey = key
+	off += n
+	tags := int(raw[off])
+	off++
+	if tags > certMaxTags {
+		return nil, nil, nil, fmt.Errorf("too many tags")
+	}
+	for ; tags > 0; tags-- {
+		if len(raw) < off+1 {
+			return nil, nil, nil, fmt.Errorf("invalid certificate tags")
+		}
+		n = int(raw[off])
+		off++
+		if n == 0 || n > certMaxTagLen || len(raw) < off+n {
+			return nil, nil, nil, fmt.Errorf("invalid certificate tags")
+		}
+		c.Tags = append(c.Tags, string(raw[off:off+n]))
+		off += n
+	}
+	return &c, raw[:off], raw[off:], nil
+}
+
+// verifyCertificate checks raw was signed by ca and is valid at now.
+func verifyCertificate(raw []byte, ca crypto.PublicKey, now time.Time) (*Certificate, error) {
+	c, signed, sig, err := parseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !verifySignature(ca, signed, sig) {
+		return nil, fmt.Errorf("certificate not signed by the CA")
+	}
+	if now.Before(c.NotBefore) || now.After(c.NotAfter) {
+		return nil, fmt.Errorf("certificate out of its validity window")
+	}
+	return c, nil
+}
+
+// MarshalCertificate encodes a certificate in PEM.
+func MarshalCertificate(raw []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "SDTL CERTIFICATE", Bytes: raw})
+}
+
+func CertificateFromPemFile(file string) ([]byte, error) {
+	b, e := os.ReadFile(file)
+	if e != nil {
+		return nil, e
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "SDTL CERTIFICATE" {
+		return nil, fmt.Errorf("failed to decode PEM block containing certificate")
+	}
+	if _, _, _, e = parseCertificate(block.Bytes); e != nil {
+		return nil, e
+	}
+	return block.Bytes, nil
+}
+
+// SetCertificate makes the next Connect present raw, issued by a CA the
+// server trusts for the socket key, instead of relying on the server
+// knowing that key.
+func (s *Socket) SetCertificate(raw []byte) error {
+	c, _, _, err := parseCertificate(raw)
+	if err != nil {
+		return err
+	}
+	pub, ok := s.signerkey.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(c.PublicKey) {
+		return fmt.Errorf("certificate is not for the socket key")
+	}
+	s.cert = raw
+	return nil
+}
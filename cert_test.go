@@ -0,0 +1,85 @@
+package sdtl
+
+import (
+	"crypto"
+	"net"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T, ca crypto.Signer, host crypto.Signer) (*Certificate, []byte) {
+	now := time.Now()
+	c := &Certificate{
+		PublicKey: host.Public(),
+		IP:        net.ParseIP("10.0.0.7"),
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(time.Hour),
+		Tags:      []string{"ops", "eu"},
+	}
+	raw, err := IssueCertificate(ca, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, raw
+}
+
+func TestCertificate(t *testing.T) {
+	for _, keyType := range []string{KeyTypeECDSA, KeyTypeEd25519} {
+		ca, err := GenerateSigner(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, err := GenerateSigner(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, raw := testCertificate(t, ca, host)
+		got, err := verifyCertificate(raw, ca.Public(), time.Now())
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if !got.IP.Equal(want.IP) || got.NotAfter.Unix() != want.NotAfter.Unix() ||
+			len(got.Tags) != 2 || got.Tags[0] != "ops" || got.Tags[1] != "eu" {
+			t.Fatalf("%s: certificate changed on the wire: %+v", keyType, got)
+		}
+		if KeyType(got.PublicKey) != keyType {
+			t.Fatalf("%s: host key type %q", keyType, KeyType(got.PublicKey))
+		}
+	}
+}
+
+func TestCertificateRejected(t *testing.T) {
+	ca, err := GenerateSigner(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateSigner(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, raw := testCertificate(t, ca, other)
+	tampered := append([]byte(nil), raw...)
+	tampered[16] ^= 1 // last byte of the address
+	now := time.Now()
+	tests := []struct {
+		name string
+		raw  []byte
+		ca   crypto.PublicKey
+		now  time.Time
+	}{
+		{"other CA", raw, other.Public(), now},
+		{"tampered", tampered, ca.Public(), now},
+		{"truncated", raw[:len(raw)-1], ca.Public(), now},
+		{"header only", raw[:certMinSize-1], ca.Public(), now},
+		{"not yet valid", raw, ca.Public(), now.Add(-2 * time.Hour)},
+		{"expired", raw, ca.Public(), now.Add(2 * time.Hour)},
+	}
+	for _, tt := range tests {
+		if _, err := verifyCertificate(tt.raw, tt.ca, tt.now); err == nil {
+			t.Fatalf("%s certificate accepted", tt.name)
+		}
+	}
+	if _, err := IssueCertificate(ca, &Certificate{PublicKey: other.Public(), IP: net.ParseIP("10.0.0.7")}); err == nil {
+		t.Fatal("certificate with an empty validity window issued")
+	}
+}
@@ -0,0 +1,405 @@
+package sdtl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// A session carries channels besides the main pipe of Socket.Read and
+// Write: independent datagram endpoints sharing its key. The packet of a
+// channel goes in frames flagged with dataFrameChannel and starts with the
+// channel id, so it is fragmented and put back together like any other.
+// A channel is opened by sending on it, with odd ids from the client and
+// even ones from the server; closing it is local, what comes for it
+// afterwards is dropped. A channel ends with its session.
+const (
+	channelIDSize = 4
+	// Packets waiting to be read per channel, and channels to be accepted
+	channelQueue = 64
+	// Channels the peer may have open at once
+	maxChannels = 1024
+)
+
+var errNoChannels = errors.New("channels not negotiated")
+
+// channelEndpoint is the side of the session the channels live on.
+type channelEndpoint interface {
+	// sendChannel seals the packet of c, its id included, for the peer.
+	sendChannel(c *Channel, packet []byte) error
+	// receive waits for the next packet of c.
+	receive(c *Channel) ([]byte, error)
+}
+
+// Channel is a datagram endpoint of a session, see OpenChannel and
+// AcceptChannel of Socket and Server.
+type Channel struct {
+	id    uint32
+	set   *channelSet
+	queue chan []byte
+	done  chan struct{}
+	err   error // why done was closed
+}
+
+// ID returns the id of the channel, the same at both ends.
+func (c *Channel) ID() uint32 {
+	return c.id
+}
+
+// Host returns the overlay address of the host at the other end, on the
+// server; on a Socket it is nil.
+func (c *Channel) Host() net.IP {
+	return c.set.host
+}
+
+// Read returns the next packet sent on the channel. A packet that does not
+// fit in b is truncated, and Read returns io.ErrShortBuffer along with what
+// fit. It returns io.EOF once the session ended.
+func (c *Channel) Read(b []byte) (int, error) {
+	p, err := c.set.ep.receive(c)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(b, p)
+	if n < len(p) {
+		return n, io.ErrShortBuffer
+	}
+	return n, nil
+}
+
+// Write sends b as one packet on the channel.
+func (c *Channel) Write(b []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, c.err
+	default:
+	}
+	if err := c.set.ep.sendChannel(c, encodeChannel(c.id, b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the channel at this end only.
+func (c *Channel) Close() error {
+	c.set.remove(c, net.ErrClosed)
+	return nil
+}
+
+// channelSet holds the channels of a session.
+type channelSet struct {
+	ep       channelEndpoint
+	host     net.IP
+	mu       sync.Mutex
+	channels map[uint32]*Channel
+	closed   map[uint32]bool // opened by the peer and closed by us
+	peers    int             // open channels the peer opened
+	next     uint32          // id of the next channel we open
+	accept   chan *Channel
+	done     chan struct{}
+	err      error
+}
+
+func newChannelSet(ep channelEndpoint, host net.IP, first uint32, accept chan *Channel) *channelSet {
+	return &channelSet{
+		ep:       ep,
+		host:     host,
+		channels: make(map[uint32]*Channel),
+		closed:   make(map[uint32]bool),
+		next:     first,
+		accept:   accept,
+		done:     make(chan struct{}),
+	}
+}
+
+// add creates the channel id; the caller holds cs.mu, or has the set to
+// itself.
+func (cs *channelSet) add(id uint32) *Channel {
+	c := &Channel{
+		id:    id,
+		set:   cs,
+		queue: make(chan []byte, channelQueue),
+		done:  make(chan struct{}),
+	}
+	cs.channels[id] = c
+	return c
+}
+
+// ours reports whether id is of the kind we open.
+func (cs *channelSet) ours(id uint32) bool {
+	return id%2 == cs.next%2
+}
+
+func (cs *channelSet) open() (*Channel, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.err != nil {
+		return nil, cs.err
+	}
+	id := cs.next
+	if id+2 < id {
+		return nil, fmt.Errorf("channel ids exhausted")
+	}
+	cs.next += 2
+	return cs.add(id), nil
+}
+
+// deliver hands a packet to channel id, which the peer opens by sending on
+// it. Packets are dropped when the channel, or the accept queue, is full.
+func (cs *channelSet) deliver(id uint32, packet []byte) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.channels[id]
+	if !ok {
+		if cs.err != nil || id == 0 || cs.ours(id) || cs.closed[id] || cs.peers >= maxChannels {
+			return
+		}
+		c = cs.add(id)
+		select {
+		case cs.accept <- c:
+			cs.peers++
+		default:
+			delete(cs.channels, id)
+			return
+		}
+	}
+	select {
+	case c.queue <- packet:
+	default:
+	}
+}
+
+// remove closes c with err.
+func (cs *channelSet) remove(c *Channel, err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.channels[c.id] != c {
+		return
+	}
+	delete(cs.channels, c.id)
+	if c.id != 0 && !cs.ours(c.id) {
+		cs.closed[c.id] = true
+		cs.peers--
+	}
+	c.err = err
+	close(c.done)
+}
+
+// forgetPeer closes with err the channels the peer opened, whose ids the
+// peer may use again in a new session.
+func (cs *channelSet) forgetPeer(err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for id, c := range cs.channels {
+		if id == 0 || cs.ours(id) {
+			continue
+		}
+		delete(cs.channels, id)
+		c.err = err
+		close(c.done)
+	}
+	cs.closed = make(map[uint32]bool)
+	cs.peers = 0
+}
+
+// close ends every channel with err. A nil set has nothing to close.
+func (cs *channelSet) close(err error) {
+	if cs == nil {
+		return
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.err != nil {
+		return
+	}
+	cs.err = err
+	for id, c := range cs.channels {
+		delete(cs.channels, id)
+		c.err = err
+		close(c.done)
+	}
+	close(cs.done)
+}
+
+// OpenChannel opens a new channel of the session. The server learns of it
+// with the first packet written on it.
+func (s *Socket) OpenChannel() (*Channel, error) {
+	s.mu.Lock()
+	caps, cs := s.caps, s.channels
+	s.mu.Unlock()
+	if cs == nil {
+		return nil, net.ErrClosed
+	}
+	if caps&capChannel == 0 {
+		return nil, errNoChannels
+	}
+	return cs.open()
+}
+
+// AcceptChannel waits for the server to open a channel. Like Read, it
+// reads from the network while it waits.
+func (s *Socket) AcceptChannel() (*Channel, error) {
+	s.mu.Lock()
+	cs := s.channels
+	s.mu.Unlock()
+	if cs == nil {
+		return nil, net.ErrClosed
+	}
+	return readUntil(s, cs.accept, cs.done, &cs.err)
+}
+
+func (s *Socket) sendChannel(c *Channel, packet []byte) error {
+	return s.send(dataFrameChannel, packet)
+}
+
+// receive waits for the next packet of c.
+func (s *Socket) receive(c *Channel) ([]byte, error) {
+	return readUntil(s, c.queue, c.done, &c.err)
+}
+
+// readUntil waits for the next value of queue, or for done, after which
+// *err tells why. There is no reading goroutine: whoever waits takes turns
+// to read a datagram from the network, and queues its packet for the
+// channel it belongs to.
+func readUntil[T any](s *Socket, queue <-chan T, done <-chan struct{}, err *error) (T, error) {
+	var none T
+	for {
+		select {
+		case v := <-queue:
+			return v, nil
+		case <-done:
+			return none, *err
+		case s.reading <- struct{}{}:
+		}
+		// Only the reader queues, so nothing can arrive unseen now
+		select {
+		case v := <-queue:
+			<-s.reading
+			return v, nil
+		case <-done:
+			<-s.reading
+			return none, *err
+		default:
+		}
+		e := s.readPacket()
+		<-s.reading
+		if e != nil {
+			return none, e
+		}
+	}
+}
+
+// deliverPacket queues a packet read from the session for its channel.
+func (s *Socket) deliverPacket(flags byte, packet []byte) {
+	if flags&dataFrameChannel == 0 {
+		s.channels.deliver(0, packet)
+		return
+	}
+	if s.caps&capChannel == 0 {
+		return
+	}
+	id, payload, err := decodeChannel(packet)
+	if err != nil {
+		return
+	}
+	s.channels.deliver(id, payload)
+}
+
+// AcceptChannel waits for a host to open a channel; Channel.Host tells
+// which.
+func (s *Server) AcceptChannel() (*Channel, error) {
+	select {
+	case c := <-s.accepted:
+		return c, nil
+	case <-s.quit:
+		return nil, net.ErrClosed
+	}
+}
+
+// OpenChannel opens a new channel with the host at the overlay address ip,
+// which must have a session that negotiated channels.
+func (s *Server) OpenChannel(ip string) (*Channel, error) {
+	var (
+		c *Channel
+		e error
+	)
+	host := net.ParseIP(ip)
+	if host == nil {
+		return nil, fmt.Errorf("invalid overlay address: %s", ip)
+	}
+	err := s.do(func(send chan<- *IOMessage) {
+		conn, err := getConnTable().getConnectionByPrivate(host)
+		if err != nil || conn.state != ConnectionReady || conn.channels == nil {
+			e = fmt.Errorf("no session with %s", ip)
+			return
+		}
+		if conn.caps&capChannel == 0 {
+			e = errNoChannels
+			return
+		}
+		c, e = conn.channels.open()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, e
+}
+
+func (s *Server) sendChannel(c *Channel, packet []byte) error {
+	var e error
+	err := s.do(func(send chan<- *IOMessage) {
+		conn, err := getConnTable().getConnectionByPrivate(c.set.host)
+		if err != nil || conn.channels != c.set || conn.state != ConnectionReady {
+			e = c.set.err
+			if e == nil {
+				e = io.EOF
+			}
+			return
+		}
+		e = s.sendPacket(conn, dataFrameChannel, packet, send)
+	})
+	if err != nil {
+		return err
+	}
+	return e
+}
+
+func (s *Server) receive(c *Channel) ([]byte, error) {
+	select {
+	case p := <-c.queue:
+		return p, nil
+	case <-c.done:
+		return nil, c.err
+	}
+}
+
+// deliverChannel hands the channel packet a host sent to its channel.
+func (s *Server) deliverChannel(conn *connection, packet []byte) error {
+	if conn.caps&capChannel == 0 || conn.channels == nil {
+		return errorf("deliverChannel", "channels not negotiated", nil)
+	}
+	id, payload, e := decodeChannel(packet)
+	if e != nil {
+		return errorf("deliverChannel", "invalid channel packet", e)
+	}
+	conn.channels.deliver(id, payload)
+	return nil
+}
+
+// do runs f in the ListenAndServe loop, which owns the sessions, and waits
+// for it to finish.
+func (s *Server) do(f func(send chan<- *IOMessage)) error {
+	done := make(chan struct{})
+	select {
+	case s.control <- func(send chan<- *IOMessage) {
+		f(send)
+		close(done)
+	}:
+	case <-s.quit:
+		return net.ErrClosed
+	}
+	<-done
+	return nil
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
 	"sdtl"
+	"syscall"
 )
 
 const (
@@ -21,6 +25,9 @@ func main() {
 	}
 
 	ip := flag.String("ip", "", "La dirección IP que quieres configurar")
+	psk := flag.String("psk", "", "Clave compartida en hex, en lugar de las claves PEM")
+	cert := flag.String("cert", "", "Certificado emitido por la CA para nuestra clave")
+	automtu := flag.Bool("automtu", false, "Ajustar el MTU de la interfaz al que descubre el camino")
 
 	// Parsear los argumentos de línea de comandos
 	flag.Parse()
@@ -30,28 +37,73 @@ func main() {
 		fmt.Println("Error: Debes proporcionar una dirección IP con el argumento -ip.")
 		os.Exit(1)
 	}
-	fmt.Println(u.SetIP(*ip, "255.255.255.0"))
-	fmt.Println(u.SetMTU(1442))
+	mask := "255.255.255.0"
+	if addr := net.ParseIP(*ip); addr != nil && addr.To4() == nil {
+		mask = "64"
+	}
+	fmt.Println(u.SetIP(*ip, mask))
+	// Los paquetes que no caben en un datagrama viajan fragmentados
+	fmt.Println(u.SetMTU(1500))
 
-	pk, e := sdtl.PrivateFromPemFile(private)
+	sd, pb, e := newSocket(*psk)
 	if e != nil {
 		fmt.Println(e)
 		return
 	}
-	sd, e := sdtl.NewSocketClient(pk)
-	if e != nil {
-		fmt.Println(e)
-		return
+	if *cert != "" {
+		raw, e := sdtl.CertificateFromPemFile(*cert)
+		if e == nil {
+			e = sd.SetCertificate(raw)
+		}
+		if e != nil {
+			fmt.Println(e)
+			return
+		}
 	}
-	pb, e := sdtl.PublicKeyFromPemFile(public)
-	if e != nil {
-		fmt.Println(e)
-		return
+	if *automtu {
+		// Sin fragmentar: el paquete más grande que cabe en un datagrama.
+		// Solo limita lo que se envía, el otro extremo puede seguir
+		// mandando paquetes de hasta 1500
+		sd.SetMTUHandler(func(mtu int) {
+			fmt.Println(u.SetMTU(mtu))
+		})
 	}
 	fmt.Println(sd.Connect("18.212.245.20:7000", pb, *ip))
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		sd.Close()
+	}()
 
 	go func() {
 		sdtl.Forward(sd, u, 1500)
 	}()
-	sdtl.Forward(u, sd, 1500)
+	sdtl.Forward(u, sd, 2048)
+}
+
+// newSocket autentica con la clave compartida si se proporcionó, si no con
+// las claves PEM.
+func newSocket(psk string) (*sdtl.Socket, crypto.PublicKey, error) {
+	if psk != "" {
+		key, e := sdtl.ParsePresharedKey(psk)
+		if e != nil {
+			return nil, nil, e
+		}
+		sd, e := sdtl.NewSocketClientPSK(key)
+		return sd, nil, e
+	}
+	pk, e := sdtl.PrivateFromPemFile(private)
+	if e != nil {
+		return nil, nil, e
+	}
+	sd, e := sdtl.NewSocketClient(pk)
+	if e != nil {
+		return nil, nil, e
+	}
+	pb, e := sdtl.PublicKeyFromPemFile(public)
+	if e != nil {
+		return nil, nil, e
+	}
+	return sd, pb, nil
 }
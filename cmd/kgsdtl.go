@@ -3,13 +3,23 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"sdtl"
+	"strings"
+	"time"
 )
 
 func main() {
+	// "kgsdtl issue ..." signs a host certificate instead
+	if len(os.Args) > 1 && os.Args[1] == "issue" {
+		issue(os.Args[2:])
+		return
+	}
+
 	// Define the --out argument to specify the base name of the files
 	out := flag.String("out", "sdtl", "Base name for the output files (default: 'sdtl')")
+	keyType := flag.String("type", sdtl.KeyTypeECDSA, "Key type: ecdsa (P-256) or ed25519")
 	showHelp := flag.Bool("help", false, "Show help message")
 
 	// Parse command-line flags
@@ -25,20 +35,20 @@ func main() {
 	}
 
 	// Generate the private key
-	pk, err := sdtl.GenerateKey()
+	pk, err := sdtl.GenerateSigner(*keyType)
 	if err != nil {
 		fmt.Printf("Error generating private key: %v\n", err)
 		os.Exit(1)
 	}
 
 	// Serialize the private and public keys
-	prikey, err := sdtl.MarshalECDSAPrivateKey(pk)
+	prikey, err := sdtl.MarshalPrivateKey(pk)
 	if err != nil {
 		fmt.Printf("Error serializing private key: %v\n", err)
 		os.Exit(1)
 	}
 
-	pubkey, err := sdtl.MarshalECDSAPublicKey(&pk.PublicKey)
+	pubkey, err := sdtl.MarshalPublicKey(pk.Public())
 	if err != nil {
 		fmt.Printf("Error serializing public key: %v\n", err)
 		os.Exit(1)
@@ -74,5 +84,64 @@ func main() {
 		os.Exit(1)
 	}
 
-	fmt.Printf("Keys successfully generated:\n- Private key: %s\n- Public key: %s\n", privateFile, publicFile)
+	fingerprint, err := sdtl.Fingerprint(pk.Public())
+	if err != nil {
+		fmt.Printf("Error computing fingerprint: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Keys successfully generated:\n- Private key: %s\n- Public key: %s\n- Fingerprint: %s\n", privateFile, publicFile, fingerprint)
+}
+
+// issue signs a certificate binding a host public key to its overlay IP
+// with the CA private key, and writes it to <out>_cert.pem.
+func issue(args []string) {
+	fs := flag.NewFlagSet("issue", flag.ExitOnError)
+	ca := fs.String("ca", "ca_private.pem", "CA private key")
+	pub := fs.String("pub", "sdtl_public.pem", "Public key of the host")
+	ip := fs.String("ip", "", "Overlay IP address of the host")
+	days := fs.Int("days", 365, "Days the certificate is valid")
+	tags := fs.String("tags", "", "Comma separated tags")
+	out := fs.String("out", "sdtl", "Base name for the output file")
+	fs.Parse(args)
+
+	addr := net.ParseIP(*ip)
+	if addr == nil {
+		fmt.Println("Error: a valid -ip is required")
+		os.Exit(1)
+	}
+	caKey, err := sdtl.PrivateFromPemFile(*ca)
+	if err != nil {
+		fmt.Printf("Error loading CA private key: %v\n", err)
+		os.Exit(1)
+	}
+	hostKey, err := sdtl.PublicKeyFromPemFile(*pub)
+	if err != nil {
+		fmt.Printf("Error loading host public key: %v\n", err)
+		os.Exit(1)
+	}
+
+	now := time.Now()
+	cert := &sdtl.Certificate{
+		PublicKey: hostKey,
+		IP:        addr,
+		NotBefore: now.Add(-time.Minute),
+		NotAfter:  now.AddDate(0, 0, *days),
+	}
+	if *tags != "" {
+		cert.Tags = strings.Split(*tags, ",")
+	}
+	raw, err := sdtl.IssueCertificate(caKey, cert)
+	if err != nil {
+		fmt.Printf("Error issuing certificate: %v\n", err)
+		os.Exit(1)
+	}
+
+	certFile := *out + "_cert.pem"
+	err = os.WriteFile(certFile, sdtl.MarshalCertificate(raw), 0644)
+	if err != nil {
+		fmt.Printf("Error writing certificate file: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Certificate %016x for %s valid until %s: %s\n", cert.Serial, addr, cert.NotAfter.Format(time.DateOnly), certFile)
 }
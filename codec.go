@@ -0,0 +1,416 @@
+package sdtl
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The wire format of every message is encoded and decoded here, without
+// any cryptography: signatures are made and checked by the callers, and
+// sealed frames are only split into their parts. Decoders check every
+// length before reading, so a malformed datagram is an error, never a
+// panic; their fuzz targets are in codec_fuzz_test.go.
+
+var (
+	errShortMessage     = errors.New("message too short")
+	errMalformed        = errors.New("malformed message")
+	errUnknownMessage   = errors.New("unknown message type")
+	errInvalidSignature = errors.New("invalid signature")
+)
+
+// Every message starts with the protocol version and its type.
+const msgHeaderSize = 2
+
+type msgHeader struct {
+	version byte
+	msgType byte
+}
+
+func (h msgHeader) encode() []byte {
+	return []byte{h.version, h.msgType}
+}
+
+// parseHeader splits a datagram into its header and body. The version is
+// left to the caller, who knows which ones it accepts.
+func parseHeader(data []byte) (msgHeader, []byte, error) {
+	if len(data) < msgHeaderSize {
+		return msgHeader{}, nil, errShortMessage
+	}
+	h := msgHeader{version: data[0], msgType: data[1]}
+	switch h.msgType {
+	case msgSTR, msgSHS, msgCHS, msgRKQ, msgRKS, msgHVR, msgHSD, msgCLS,
+		msgKAL, msgFRG, msgPRB, msgPRA, msgREJ, msgUSN, msgDFE:
+	default:
+		return h, nil, fmt.Errorf("%w: %02x", errUnknownMessage, h.msgType)
+	}
+	return h, data[msgHeaderSize:], nil
+}
+
+// encode returns the signed part of a STR: address, session, timestamp,
+// versions, capabilities, then the ML-KEM key and the certificate, with its
+// length in two bytes, when the capabilities say so.
+func (hs *startHandShake) encode() ([]byte, error) {
+	if len(hs.versions) == 0 || len(hs.versions) > maxVersions {
+		return nil, fmt.Errorf("invalid version list")
+	}
+	if (hs.caps&capHybrid != 0) != (len(hs.ek) == sizeKEMKey) {
+		return nil, fmt.Errorf("invalid encapsulation key")
+	}
+	if (hs.caps&capCert != 0) != (len(hs.cert) != 0) || len(hs.cert) > 0xffff {
+		return nil, fmt.Errorf("invalid certificate")
+	}
+	capOffset := strVerOffset + 1 + len(hs.versions)
+	certOffset := capOffset + 4 + len(hs.ek)
+	sigOffset := certOffset
+	if len(hs.cert) != 0 {
+		sigOffset += 2 + len(hs.cert)
+	}
+	buf := make([]byte, sigOffset)
+
+	copy(buf[0:strSesOffset], hs.ip[:])
+	copy(buf[strSesOffset:strTimOffset], hs.session[:])
+	binary.BigEndian.PutUint64(buf[strTimOffset:strVerOffset], hs.timestamp)
+	buf[strVerOffset] = byte(len(hs.versions))
+	copy(buf[strVerOffset+1:], hs.versions)
+	binary.BigEndian.PutUint32(buf[capOffset:capOffset+4], hs.caps)
+	copy(buf[capOffset+4:certOffset], hs.ek)
+	if len(hs.cert) != 0 {
+		binary.BigEndian.PutUint16(buf[certOffset:], uint16(len(hs.cert)))
+		copy(buf[certOffset+2:], hs.cert)
+	}
+	return buf, nil
+}
+
+// decode reads the STR at the start of data, followed by a signature of
+// sigSize bytes, or by none when sigSize is 0. It returns the length read;
+// what comes after, such as a cookie, is for the caller.
+func (hs *startHandShake) decode(data []byte, sigSize int) (int, error) {
+	if len(data) < strMinSize {
+		return 0, errShortMessage
+	}
+	n := int(data[strVerOffset])
+	if n == 0 || n > maxVersions {
+		return 0, fmt.Errorf("%w: %d versions", errMalformed, n)
+	}
+	off := strVerOffset + 1 + n
+	if len(data) < off+4 {
+		return 0, errShortMessage
+	}
+	copy(hs.ip[:], data[:strSesOffset])
+	copy(hs.session[:], data[strSesOffset:strTimOffset])
+	hs.timestamp = binary.BigEndian.Uint64(data[strTimOffset:strVerOffset])
+	hs.versions = append([]byte(nil), data[strVerOffset+1:off]...)
+	hs.caps = binary.BigEndian.Uint32(data[off : off+4])
+	off += 4
+	hs.ek = nil
+	if hs.caps&capHybrid != 0 {
+		if len(data) < off+sizeKEMKey {
+			return 0, errShortMessage
+		}
+		hs.ek = append([]byte(nil), data[off:off+sizeKEMKey]...)
+		off += sizeKEMKey
+	}
+	hs.cert = nil
+	if hs.caps&capCert != 0 {
+		if len(data) < off+2 {
+			return 0, errShortMessage
+		}
+		n = int(binary.BigEndian.Uint16(data[off:]))
+		off += 2
+		if n == 0 {
+			return 0, fmt.Errorf("%w: empty certificate", errMalformed)
+		}
+		if len(data) < off+n {
+			return 0, errShortMessage
+		}
+		hs.cert = append([]byte(nil), data[off:off+n]...)
+		off += n
+	}
+	hs.signature = nil
+	if sigSize > 0 {
+		if len(data) < off+sigSize {
+			return 0, errShortMessage
+		}
+		hs.signature = append([]byte(nil), data[off:off+sigSize]...)
+		off += sigSize
+	}
+	return off, nil
+}
+
+// encode returns the signed part of an SHS or CHS.
+func (hs *handShake) encode() ([]byte, error) {
+	if len(hs.kem) != 0 && (hs.caps&capHybrid == 0 || len(hs.kem) != sizeKEMCT) {
+		return nil, fmt.Errorf("invalid ciphertext")
+	}
+	buf := make([]byte, xhsSigOffset+len(hs.kem))
+	copy(buf, hs.session[:])
+	buf[xhsVerOffset] = hs.version
+	binary.BigEndian.PutUint32(buf[xhsCapOffset:xhsEPKOffset], hs.caps)
+	copy(buf[xhsEPKOffset:], hs.epk[:])
+	copy(buf[xhsSigOffset:], hs.kem)
+	return buf, nil
+}
+
+// decode reads an SHS or CHS that takes all of data. The length tells
+// whether the ML-KEM ciphertext is there, which only capHybrid allows;
+// whether it must be there depends on the message.
+func (hs *handShake) decode(data []byte, sigSize int) error {
+	if sigSize == 0 || len(data) < xhsSigOffset+sigSize {
+		return errShortMessage
+	}
+	hs.caps = binary.BigEndian.Uint32(data[xhsCapOffset:xhsEPKOffset])
+	hs.kem = nil
+	switch len(data) {
+	case xhsSigOffset + sigSize:
+	case xhsSigOffset + sizeKEMCT + sigSize:
+		if hs.caps&capHybrid == 0 {
+			return fmt.Errorf("%w: ciphertext without hybrid", errMalformed)
+		}
+		hs.kem = append([]byte(nil), data[xhsSigOffset:xhsSigOffset+sizeKEMCT]...)
+	default:
+		return fmt.Errorf("%w: %d bytes", errMalformed, len(data))
+	}
+	copy(hs.session[:], data[:xhsVerOffset])
+	hs.version = data[xhsVerOffset]
+	copy(hs.epk[:], data[xhsEPKOffset:xhsSigOffset])
+	sigOffset := xhsSigOffset + len(hs.kem)
+	hs.signature = append([]byte(nil), data[sigOffset:]...)
+	return nil
+}
+
+// encode returns the signed part of an HSD.
+func (hs *handShakeDone) encode() []byte {
+	buf := make([]byte, hsdSigOffset)
+	copy(buf, hs.session[:])
+	copy(buf[hsdHshOffset:], hs.transcript[:])
+	copy(buf[hsdMACOffset:], hs.mac[:])
+	return buf
+}
+
+// decode reads an HSD that takes all of data.
+func (hs *handShakeDone) decode(data []byte, sigSize int) error {
+	if sigSize == 0 || len(data) < hsdSigOffset+sigSize {
+		return errShortMessage
+	}
+	if len(data) != hsdSigOffset+sigSize {
+		return fmt.Errorf("%w: %d bytes", errMalformed, len(data))
+	}
+	copy(hs.session[:], data[:hsdHshOffset])
+	copy(hs.transcript[:], data[hsdHshOffset:hsdMACOffset])
+	copy(hs.mac[:], data[hsdMACOffset:hsdSigOffset])
+	hs.signature = append([]byte(nil), data[hsdSigOffset:]...)
+	return nil
+}
+
+// encode returns the signed part of a REJ.
+func (hs *handShakeReject) encode() []byte {
+	buf := make([]byte, rejSigOffset)
+	copy(buf, hs.session[:])
+	buf[rejRsnOffset] = hs.reason
+	return buf
+}
+
+// decode reads a REJ that takes all of data.
+func (hs *handShakeReject) decode(data []byte, sigSize int) error {
+	if sigSize == 0 || len(data) < rejSigOffset+sigSize {
+		return errShortMessage
+	}
+	if len(data) != rejSigOffset+sigSize {
+		return fmt.Errorf("%w: %d bytes", errMalformed, len(data))
+	}
+	copy(hs.session[:], data[:rejRsnOffset])
+	hs.reason = data[rejRsnOffset]
+	hs.signature = append([]byte(nil), data[rejSigOffset:]...)
+	return nil
+}
+
+func (hv *helloVerify) encode() []byte {
+	buf := make([]byte, sizeHVR)
+	copy(buf[0:hvrCkOffset], hv.session[:])
+	copy(buf[hvrCkOffset:], hv.cookie[:])
+	return buf
+}
+
+// decode reads an HVR that takes all of data.
+func (hv *helloVerify) decode(data []byte) error {
+	if len(data) < sizeHVR {
+		return errShortMessage
+	}
+	if len(data) != sizeHVR {
+		return fmt.Errorf("%w: %d bytes", errMalformed, len(data))
+	}
+	copy(hv.session[:], data[0:hvrCkOffset])
+	copy(hv.cookie[:], data[hvrCkOffset:sizeHVR])
+	return nil
+}
+
+// encode returns a USN without its signature.
+func (usn *unknownSession) encode() []byte {
+	buf := make([]byte, usnSigOffset)
+	copy(buf, usn.session[:])
+	copy(buf[usnCkOffset:], usn.cookie[:])
+	copy(buf[usnIPOffset:], usn.ip[:])
+	return buf[:usn.bodySize()]
+}
+
+// encodeChallenge returns the USN challenge, which has no address.
+func (usn *unknownSession) encodeChallenge() []byte {
+	return usn.encode()[:usnIPOffset]
+}
+
+// decodeChallenge reads a USN challenge that takes all of data.
+func (usn *unknownSession) decodeChallenge(data []byte) error {
+	if len(data) != usnIPOffset {
+		return fmt.Errorf("%w: %d bytes", errMalformed, len(data))
+	}
+	copy(usn.session[:], data[:usnCkOffset])
+	copy(usn.cookie[:], data[usnCkOffset:usnIPOffset])
+	usn.ip = [16]byte{}
+	usn.signature = nil
+	return nil
+}
+
+// decode reads a USN of usn.version that takes all of data, the echo of a
+// challenge when sigSize is 0.
+func (usn *unknownSession) decode(data []byte, sigSize int) error {
+	size := usn.bodySize()
+	if len(data) < size+sigSize {
+		return errShortMessage
+	}
+	if len(data) != size+sigSize {
+		return fmt.Errorf("%w: %d bytes", errMalformed, len(data))
+	}
+	copy(usn.session[:], data[:usnCkOffset])
+	copy(usn.cookie[:], data[usnCkOffset:usnIPOffset])
+	usn.ip = [16]byte{}
+	copy(usn.ip[:], data[usnIPOffset:size])
+	usn.signature = nil
+	if sigSize > 0 {
+		usn.signature = append([]byte(nil), data[size:]...)
+	}
+	return nil
+}
+
+// sealedFrame is a frame sealed with a session key, split into its parts,
+// see data.go for the layout.
+type sealedFrame struct {
+	msgHeader
+	flags      byte
+	session    [8]byte
+	counter    uint64
+	salt       []byte
+	tag        []byte
+	ciphertext []byte
+	header     []byte // all before the tag, the associated data
+}
+
+// frameSession returns the session a sealed frame claims to belong to,
+// which is all there is to read before the suite of the session is known.
+func frameSession(buffer []byte) ([8]byte, error) {
+	var session [8]byte
+	if len(buffer) < dataFrameMinSize {
+		return session, errShortMessage
+	}
+	copy(session[:], buffer[dataFrameSessionOffset:dataFrameCounterOffset])
+	return session, nil
+}
+
+// parseFrame splits a whole sealed frame, header included, for a suite
+// whose salt is saltSize long.
+func parseFrame(data []byte, saltSize int) (*sealedFrame, error) {
+	tagOffset := dataFrameSaltOffset + saltSize
+	if len(data) < tagOffset+dataFrameTagSize {
+		return nil, errShortMessage
+	}
+	f := &sealedFrame{
+		msgHeader: msgHeader{
+			version: data[dataFrameVersionOffset],
+			msgType: data[dataFrameTypeOffset],
+		},
+		flags:      data[dataFrameFlagsOffset],
+		counter:    binary.BigEndian.Uint64(data[dataFrameCounterOffset:dataFrameSaltOffset]),
+		salt:       data[dataFrameSaltOffset:tagOffset],
+		tag:        data[tagOffset : tagOffset+dataFrameTagSize],
+		ciphertext: data[tagOffset+dataFrameTagSize:],
+		header:     data[:tagOffset],
+	}
+	copy(f.session[:], data[dataFrameSessionOffset:dataFrameCounterOffset])
+	if f.flags&^dataFrameFlags != 0 {
+		return nil, fmt.Errorf("%w: unknown flags %02x", errMalformed, f.flags)
+	}
+	return f, nil
+}
+
+// encodeHeader writes the header of f, the salt included, at the start of
+// buf, which must have room for it.
+func (f *sealedFrame) encodeHeader(buf []byte) {
+	buf[dataFrameVersionOffset] = f.version
+	buf[dataFrameTypeOffset] = f.msgType
+	buf[dataFrameFlagsOffset] = f.flags
+	copy(buf[dataFrameSessionOffset:dataFrameCounterOffset], f.session[:])
+	binary.BigEndian.PutUint64(buf[dataFrameCounterOffset:dataFrameSaltOffset], f.counter)
+	copy(buf[dataFrameSaltOffset:], f.salt)
+}
+
+// decodeRekey reads the ECDH public key an RKQ or RKS carries.
+func decodeRekey(data []byte) ([sizeRKX]byte, error) {
+	var epk [sizeRKX]byte
+	if len(data) != sizeRKX {
+		return epk, fmt.Errorf("%w: rekey key of %d bytes", errMalformed, len(data))
+	}
+	copy(epk[:], data)
+	return epk, nil
+}
+
+// encodeProbe returns the payload of PRB id, padded to size bytes.
+func encodeProbe(id uint32, size int) []byte {
+	payload := make([]byte, max(size, pmtuProbeHeaderSize))
+	binary.BigEndian.PutUint32(payload, id)
+	return payload
+}
+
+// decodeProbe returns the id of a PRB, whatever its padding.
+func decodeProbe(data []byte) (uint32, error) {
+	if len(data) < pmtuProbeHeaderSize {
+		return 0, errShortMessage
+	}
+	return binary.BigEndian.Uint32(data), nil
+}
+
+// encodeProbeAck returns the payload of the PRA for probe id, which arrived
+// with size bytes.
+func encodeProbeAck(id uint32, size int) []byte {
+	ack := make([]byte, pmtuAckSize)
+	binary.BigEndian.PutUint32(ack, id)
+	binary.BigEndian.PutUint16(ack[4:], uint16(size))
+	return ack
+}
+
+// decodeProbeAck returns the id and the size of the probe a PRA answers.
+func decodeProbeAck(data []byte) (uint32, int, error) {
+	if len(data) != pmtuAckSize {
+		return 0, 0, fmt.Errorf("%w: probe ack of %d bytes", errMalformed, len(data))
+	}
+	return binary.BigEndian.Uint32(data), int(binary.BigEndian.Uint16(data[4:])), nil
+}
+
+// encodeChannel returns the packet of channel id carrying payload.
+func encodeChannel(id uint32, payload []byte) []byte {
+	packet := make([]byte, channelIDSize+len(payload))
+	binary.BigEndian.PutUint32(packet, id)
+	copy(packet[channelIDSize:], payload)
+	return packet
+}
+
+// decodeChannel returns the id and the payload of a channel packet.
+func decodeChannel(packet []byte) (uint32, []byte, error) {
+	if len(packet) < channelIDSize {
+		return 0, nil, errShortMessage
+	}
+	id := binary.BigEndian.Uint32(packet)
+	if id == 0 {
+		return 0, nil, fmt.Errorf("%w: channel 0", errMalformed)
+	}
+	return id, packet[channelIDSize:], nil
+}
@@ -0,0 +1,362 @@
+package sdtl
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// Every decoder must either fail or read back what the encoder wrote; none
+// may panic, whatever the input.
+
+func testSTR(t testing.TB, caps uint32) []byte {
+	signer, err := GenerateSigner(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := startHandShake{
+		timestamp: uint64(time.Now().Unix()),
+		versions:  supportedVersions,
+		caps:      caps,
+	}
+	copy(start.ip[:], net.ParseIP("10.9.0.2").To16())
+	start.session = createRandomSession()
+	if caps&capHybrid != 0 {
+		start.ek = make([]byte, sizeKEMKey)
+	}
+	if caps&capCert != 0 {
+		start.cert, err = IssueCertificate(signer, &Certificate{
+			PublicKey: signer.Public(),
+			IP:        net.ParseIP("10.9.0.2"),
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(time.Hour),
+			Tags:      []string{"test"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := packHandShakeMessage(signer, ProtocolVer, msgSTR, &start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func testFrame(t testing.TB, suite *cipherSuite, msgType byte, payload []byte) []byte {
+	c, err := newCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.version = ProtocolVer
+	c.suite = suite
+	c.txKey = make([]byte, 32)
+	data, err := packDataFrame(c, msgType, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func FuzzParseHeader(f *testing.F) {
+	f.Add([]byte{ProtocolVer, msgSTR})
+	f.Add([]byte{ProtocolVer, msgDFE, 1, 2, 3})
+	f.Add([]byte{ProtocolVer, 0x7f})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, body, err := parseHeader(data)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(append(h.encode(), body...), data) {
+			t.Fatalf("header round trip: %x", data)
+		}
+	})
+}
+
+func FuzzDecodeSTR(f *testing.F) {
+	f.Add(testSTR(f, capRekey|capSuiteAESGCM)[msgHeaderSize:])
+	f.Add(testSTR(f, capHybrid|capSuiteAESGCM)[msgHeaderSize:])
+	f.Add(testSTR(f, capCert|capSuiteChaCha20)[msgHeaderSize:])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, sigSize := range []int{0, 32, 64} {
+			var hs startHandShake
+			n, err := hs.decode(data, sigSize)
+			if err != nil {
+				continue
+			}
+			body, err := hs.encode()
+			if err != nil {
+				t.Fatalf("decoded STR does not encode: %v", err)
+			}
+			if !bytes.Equal(append(body, hs.signature...), data[:n]) {
+				t.Fatalf("STR round trip: %x", data)
+			}
+		}
+	})
+}
+
+func FuzzDecodeHandShake(f *testing.F) {
+	hs := handShake{version: ProtocolVer, caps: capHybrid | capSuiteAESGCM, kem: make([]byte, sizeKEMCT)}
+	body, _ := hs.encode()
+	f.Add(append(body, make([]byte, 64)...))
+	hs.kem = nil
+	body, _ = hs.encode()
+	f.Add(append(body, make([]byte, 32)...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, sigSize := range []int{0, 32, 64} {
+			var hs handShake
+			if hs.decode(data, sigSize) != nil {
+				continue
+			}
+			body, err := hs.encode()
+			if err != nil {
+				t.Fatalf("decoded handshake does not encode: %v", err)
+			}
+			if !bytes.Equal(append(body, hs.signature...), data) {
+				t.Fatalf("handshake round trip: %x", data)
+			}
+		}
+	})
+}
+
+func FuzzDecodeHandShakeDone(f *testing.F) {
+	done := handShakeDone{session: createRandomSession()}
+	f.Add(append(done.encode(), make([]byte, 64)...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, sigSize := range []int{0, 32, 64} {
+			var hs handShakeDone
+			if hs.decode(data, sigSize) != nil {
+				continue
+			}
+			if !bytes.Equal(append(hs.encode(), hs.signature...), data) {
+				t.Fatalf("handshake done round trip: %x", data)
+			}
+		}
+	})
+}
+
+func FuzzDecodeReject(f *testing.F) {
+	rej := handShakeReject{session: createRandomSession(), reason: rejectUnauthorized}
+	f.Add(append(rej.encode(), make([]byte, 64)...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, sigSize := range []int{0, 32, 64} {
+			var hs handShakeReject
+			if hs.decode(data, sigSize) != nil {
+				continue
+			}
+			if !bytes.Equal(append(hs.encode(), hs.signature...), data) {
+				t.Fatalf("reject round trip: %x", data)
+			}
+		}
+	})
+}
+
+func FuzzDecodeUnknownSession(f *testing.F) {
+	for _, version := range supportedVersions {
+		usn := unknownSession{version: version, session: createRandomSession()}
+		f.Add(usn.encode())
+		f.Add(append(usn.encode(), make([]byte, 64)...))
+		f.Add(usn.encodeChallenge())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var challenge unknownSession
+		if challenge.decodeChallenge(data) == nil && !bytes.Equal(challenge.encodeChallenge(), data) {
+			t.Fatalf("unknown session challenge round trip: %x", data)
+		}
+		for _, version := range supportedVersions {
+			for _, sigSize := range []int{0, 32, 64} {
+				usn := unknownSession{version: version}
+				if usn.decode(data, sigSize) != nil {
+					continue
+				}
+				if !bytes.Equal(append(usn.encode(), usn.signature...), data) {
+					t.Fatalf("unknown session round trip in %x: %x", version, data)
+				}
+			}
+		}
+	})
+}
+
+func FuzzDecodeHelloVerify(f *testing.F) {
+	hv := helloVerify{session: createRandomSession()}
+	f.Add(hv.encode())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var hv helloVerify
+		if hv.decode(data) != nil {
+			return
+		}
+		if !bytes.Equal(hv.encode(), data) {
+			t.Fatalf("hello verify round trip: %x", data)
+		}
+	})
+}
+
+func FuzzParseFrame(f *testing.F) {
+	for _, suite := range cipherSuites {
+		f.Add(testFrame(f, suite, msgDFE, []byte("payload")))
+		f.Add(testFrame(f, suite, msgKAL, nil))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, suite := range cipherSuites {
+			frame, err := parseFrame(data, suite.saltSize)
+			if err != nil {
+				continue
+			}
+			buf := make([]byte, len(frame.header))
+			frame.encodeHeader(buf)
+			buf = append(append(buf, frame.tag...), frame.ciphertext...)
+			if !bytes.Equal(buf, data) {
+				t.Fatalf("frame round trip: %x", data)
+			}
+		}
+	})
+}
+
+func FuzzDecodeRekey(f *testing.F) {
+	c, err := newCipher()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(c.PublicKey())
+	f.Add([]byte{4})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		epk, err := decodeRekey(data)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(epk[:], data) {
+			t.Fatalf("rekey round trip: %x", data)
+		}
+	})
+}
+
+func FuzzDecodeProbe(f *testing.F) {
+	f.Add(encodeProbe(7, 1200))
+	f.Add(encodeProbeAck(7, 1200))
+	f.Add([]byte{0, 0, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if id, err := decodeProbe(data); err == nil {
+			if !bytes.Equal(encodeProbe(id, len(data))[:pmtuProbeHeaderSize], data[:pmtuProbeHeaderSize]) {
+				t.Fatalf("probe round trip: %x", data)
+			}
+		}
+		if id, size, err := decodeProbeAck(data); err == nil {
+			if !bytes.Equal(encodeProbeAck(id, size), data) {
+				t.Fatalf("probe ack round trip: %x", data)
+			}
+		}
+	})
+}
+
+func FuzzDecodeChannel(f *testing.F) {
+	f.Add(encodeChannel(1, []byte("payload")))
+	f.Add(encodeChannel(2, nil))
+	f.Add([]byte{0, 0, 0, 0, 'x'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		id, payload, err := decodeChannel(data)
+		if err != nil {
+			return
+		}
+		if id == 0 || !bytes.Equal(encodeChannel(id, payload), data) {
+			t.Fatalf("channel round trip: %x", data)
+		}
+	})
+}
+
+func FuzzReassembly(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 1, 0, 2, 'a'}, []byte{0, 0, 0, 1, 1, 2, 'b'})
+	f.Add([]byte{0, 0, 0, 1, 0, 2, 'a'}, []byte{0, 0, 0, 1, 0, 3, 'b'})
+	f.Fuzz(func(t *testing.T, a, b []byte) {
+		var r reassembly
+		now := time.Now()
+		r.add(a, now)
+		r.add(b, now)
+		if r.bytes < 0 || r.bytes > reassemblyMaxBytes || len(r.packets) > reassemblyMaxPackets {
+			t.Fatalf("reassembly out of bounds: %d bytes, %d packets", r.bytes, len(r.packets))
+		}
+	})
+}
+
+func FuzzParseCertificate(f *testing.F) {
+	f.Add(testSTR(f, capCert|capSuiteAESGCM))
+	ca, _ := GenerateSigner(KeyTypeECDSA)
+	raw, _ := IssueCertificate(ca, &Certificate{
+		PublicKey: ca.Public(),
+		IP:        net.ParseIP("fd00::2"),
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(time.Hour),
+	})
+	f.Add(raw)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c, signed, _, err := parseCertificate(data)
+		if err != nil {
+			return
+		}
+		buf, err := c.marshal()
+		if err != nil {
+			return // a key or address the encoder does not take
+		}
+		if !bytes.Equal(buf, signed) {
+			t.Fatalf("certificate round trip: %x", data)
+		}
+	})
+}
+
+// emptyConnTable gives tb a connection table of its own, as the server
+// loop uses it, and puts the previous one back when tb is done.
+func emptyConnTable(tb testing.TB) *connTable {
+	ct := getConnTable()
+	saved := *ct
+	*ct = connTable{
+		private:  make(map[[16]byte]*connection),
+		public:   make(map[netip.AddrPort]*connection),
+		sessions: make(map[[8]byte]*connection),
+	}
+	tb.Cleanup(func() { *ct = saved })
+	return ct
+}
+
+// FuzzServerMessage feeds datagrams to the server dispatcher, which must
+// drop what it cannot use without panicking.
+func FuzzServerMessage(f *testing.F) {
+	signer, err := GenerateSigner(KeyTypeEd25519)
+	if err != nil {
+		f.Fatal(err)
+	}
+	cookies, err := newCookieJar(0)
+	if err != nil {
+		f.Fatal(err)
+	}
+	psk, _ := ParsePresharedKey("000102030405060708090a0b0c0d0e0f")
+	emptyConnTable(f).addPrivate(net.ParseIP("10.9.0.2"), hostAuth{psk: psk}, capSuites&supportedCaps)
+	s := &Server{
+		priKey:           signer,
+		cookies:          cookies,
+		idleTimeout:      DefaultIdleTimeout,
+		handshakeTimeout: DefaultHandshakeTimeout,
+		handshakeSkew:    DefaultHandshakeSkew,
+		maxDatagram:      DefaultMaxDatagram,
+	}
+	s.ca = signer.Public()
+	send := make(chan *IOMessage, 256)
+
+	f.Add(testSTR(f, capRekey|capSuiteAESGCM))
+	f.Add(testSTR(f, capHybrid|capCert|capSuiteAESGCM))
+	f.Add(testFrame(f, cipherSuites[0], msgDFE, []byte("payload")))
+	f.Add(testFrame(f, cipherSuites[0], msgFRG, []byte{0, 0, 0, 1, 0, 2, 'a'}))
+	f.Add([]byte{ProtocolVer, msgCHS})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg IOMessage
+		if len(data) > len(msg.buffer) {
+			return
+		}
+		msg.addr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 7000}
+		msg.n = copy(msg.buffer[:], data)
+		s.handleMessage(&msg, send)
+		for len(send) > 0 {
+			<-send
+		}
+	})
+}
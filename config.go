@@ -2,18 +2,48 @@ package sdtl
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
 	"os"
+	"strconv"
 )
 
 type ServerConfig struct {
-	Listen     string `json:"listen"`
-	Port       int    `json:"port"`
-	PrivateKey string `json:"private_key"`
+	Listen string `json:"listen"`
+	Port   int    `json:"port"`
+	// More "host:port" addresses to listen on, of either family
+	Addresses  []string `json:"addresses"`
+	PrivateKey string   `json:"private_key"`
+	// Rekey a session after this many seconds or bytes, 0 for the default
+	RekeyAfter int    `json:"rekey_after"`
+	RekeyBytes uint64 `json:"rekey_bytes"`
+	// Demand a cookie once more than this many STR arrive in a second, 0 never
+	CookieThreshold int `json:"cookie_threshold"`
+	// Seconds before a silent session or an unfinished handshake is dropped,
+	// 0 for the default
+	IdleTimeout      int `json:"idle_timeout"`
+	HandshakeTimeout int `json:"handshake_timeout"`
+	// Seconds a STR timestamp may differ from our clock, 0 for the default
+	HandshakeSkew int `json:"handshake_skew"`
+	// Public key of the CA whose host certificates are accepted, if any
+	CA string `json:"ca"`
+	// File of revoked key fingerprints and certificate serials, if any
+	Revocations string `json:"revocations"`
+	// Largest UDP payload sent, up to where path MTU discovery searches;
+	// larger packets are fragmented. 0 for the default
+	MaxDatagram int `json:"max_datagram"`
+	// Most USN of each kind sent in a second to clients of unknown sessions,
+	// 0 for the default
+	UnknownSessionRate int `json:"unknown_session_rate"`
 }
 
 type HostConfig struct {
 	IP        string `json:"ip"`
 	PublicKey string `json:"public_key"`
+	// Hex shared secret, in place of public_key or next to it
+	PSK string `json:"psk"`
+	// Cipher suites the host may use, by name, empty for all of them
+	CipherSuites []string `json:"cipher_suites"`
 }
 
 type Config struct {
@@ -21,6 +51,40 @@ type Config struct {
 	Hosts  []HostConfig `json:"hosts"`
 }
 
+// listenAddresses returns listen:port, when set, followed by Addresses.
+func (c *ServerConfig) listenAddresses() []string {
+	var addrs []string
+	if c.Listen != "" || c.Port != 0 {
+		addrs = append(addrs, net.JoinHostPort(c.Listen, strconv.Itoa(c.Port)))
+	}
+	return append(addrs, c.Addresses...)
+}
+
+// auth loads what the host authenticates with: its public key, its PSK, or
+// both.
+func (h *HostConfig) auth() (hostAuth, error) {
+	var (
+		auth hostAuth
+		err  error
+	)
+	if h.PublicKey == "" && h.PSK == "" {
+		return auth, fmt.Errorf("host %s has neither public_key nor psk", h.IP)
+	}
+	if h.PublicKey != "" {
+		auth.publicKey, err = PublicKeyFromPemFile(h.PublicKey)
+		if err != nil {
+			return auth, err
+		}
+	}
+	if h.PSK != "" {
+		auth.psk, err = ParsePresharedKey(h.PSK)
+		if err != nil {
+			return auth, fmt.Errorf("host %s: %w", h.IP, err)
+		}
+	}
+	return auth, nil
+}
+
 func ParseConfig(filePath string) (*Config, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
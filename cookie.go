@@ -0,0 +1,136 @@
+package sdtl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+	"time"
+)
+
+const (
+	cookieSize   = 16
+	sizeHVR      = 8 + cookieSize
+	hvrCkOffset  = 8
+	cookieRotate = 2 * time.Minute
+)
+
+// helloVerify is the server answer to a STR while it is under load. It
+// carries no state: the cookie is an HMAC over the source address and the
+// session, and the client proves it owns that address by echoing it at the
+// end of a new STR. Being smaller than a STR it cannot be used to amplify.
+type helloVerify struct {
+	session [8]byte
+	cookie  [cookieSize]byte
+}
+
+// cookieJar decides when a STR must carry a cookie and issues and checks
+// them. The secret is rotated periodically and the previous one is still
+// accepted, so a cookie stays valid for at least one rotation period.
+type cookieJar struct {
+	threshold int
+	secret    [32]byte
+	previous  [32]byte
+	rotated   time.Time
+	second    time.Time
+	count     int
+}
+
+func newCookieJar(threshold int) (*cookieJar, error) {
+	j := &cookieJar{threshold: threshold}
+	if _, e := rand.Read(j.secret[:]); e != nil {
+		return nil, e
+	}
+	j.previous = j.secret
+	j.rotated = time.Now()
+	return j, nil
+}
+
+// required counts the STR and reports whether the rate seen in the current
+// second is above the threshold. A threshold of 0 disables cookies.
+func (j *cookieJar) required() bool {
+	if j.threshold <= 0 {
+		return false
+	}
+	now := time.Now()
+	if now.Sub(j.second) >= time.Second {
+		j.second = now
+		j.count = 0
+	}
+	j.count++
+	return j.count > j.threshold
+}
+
+func (j *cookieJar) rotate() {
+	if time.Since(j.rotated) < cookieRotate {
+		return
+	}
+	j.previous = j.secret
+	rand.Read(j.secret[:])
+	j.rotated = time.Now()
+}
+
+func computeCookie(secret []byte, addr *net.UDPAddr, session []byte) [cookieSize]byte {
+	var cookie [cookieSize]byte
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(addr.String()))
+	mac.Write(session)
+	copy(cookie[:], mac.Sum(nil))
+	return cookie
+}
+
+func (j *cookieJar) issue(addr *net.UDPAddr, session []byte) [cookieSize]byte {
+	j.rotate()
+	return computeCookie(j.secret[:], addr, session)
+}
+
+func (j *cookieJar) verify(addr *net.UDPAddr, session []byte, cookie []byte) bool {
+	j.rotate()
+	cur := computeCookie(j.secret[:], addr, session)
+	if hmac.Equal(cur[:], cookie) {
+		return true
+	}
+	prev := computeCookie(j.previous[:], addr, session)
+	return hmac.Equal(prev[:], cookie)
+}
+
+// checkCookie reports whether the STR in msg may go on to handleSTR. When
+// it may not, it returns the HVR to send back, or nil to drop a STR from a
+// client that does not understand cookies.
+func (j *cookieJar) checkCookie(msg *IOMessage) (*IOMessage, bool) {
+	if !j.required() {
+		return nil, true
+	}
+	var start startHandShake
+	body := msg.buffer[msgHeaderSize:msg.n]
+	if _, e := start.decode(body, 0); e != nil {
+		return nil, true
+	}
+	// The signature length, and so where the cookie starts, depends on the
+	// host key
+	conn, _ := getConnTable().getConnectionByPrivate(extractIP(start.ip[:]))
+	size := strSize(body, signatureSize(strKey(&start, conn)))
+	if size == 0 {
+		// Malformed, nothing handleSTR could verify either
+		return nil, false
+	}
+	session := start.session[:]
+	if len(body) == size+cookieSize && j.verify(msg.addr, session, body[size:]) {
+		return nil, true
+	}
+	if start.caps&capCookie == 0 {
+		return nil, false
+	}
+	return j.helloVerify(msg, start.session), false
+}
+
+// helloVerify turns the STR in msg into the HVR answering it.
+func (j *cookieJar) helloVerify(msg *IOMessage, session [8]byte) *IOMessage {
+	var hv helloVerify
+	hv.session = session
+	hv.cookie = j.issue(msg.addr, session[:])
+	data := append(msgHeader{replyVersion(msg), msgHVR}.encode(), hv.encode()...)
+	copy(msg.buffer[:], data)
+	msg.n = len(data)
+	return msg
+}
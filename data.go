@@ -1,41 +1,105 @@
 package sdtl
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+// Every frame sealed with a session key starts with a header: version,
+// type and flags, then the session it belongs to, so the receiver finds it
+// without looking at the source address, and the counter. The salt, when
+// the suite has one, ends it, so the tag and ciphertext offsets depend on
+// the cipher suite, see cipherSuite.tagOffset. The whole header is
+// authenticated as associated data, and new fields go in it.
+const (
+	dataFrameTagSize       = 16
+	dataFrameSessionSize   = 8
+	dataFrameCounterSize   = 8
+	dataFrameVersionOffset = 0
+	dataFrameTypeOffset    = 1
+	dataFrameFlagsOffset   = 2
+	dataFrameSessionOffset = 3
+	dataFrameCounterOffset = dataFrameSessionOffset + dataFrameSessionSize
+	dataFrameSaltOffset    = dataFrameCounterOffset + dataFrameCounterSize
+	dataFrameMinSize       = dataFrameSaltOffset + dataFrameTagSize
+)
 
+// Flags of a sealed frame; a frame with an unknown one is refused.
 const (
-	dataFrameTagSize          = 16
-	dataFrameNonceSize        = 12
-	dataFrameNonceOffset      = 0
-	dataFrameTagOffset        = 12
-	dataFrameCipherTextOffset = 12 + 16
+	// The packet belongs to a channel and starts with its id
+	dataFrameChannel = 1 << 0
+
+	dataFrameFlags = dataFrameChannel
 )
 
+var errReplayedFrame = errors.New("replayed frame")
+
 func loadDataFrame(c *aesCipher, buffer []byte) ([]byte, error) {
-	if len(buffer) < dataFrameCipherTextOffset {
-		return nil, fmt.Errorf("buffer too small")
+	f, e := parseFrame(buffer, c.suite.saltSize)
+	if e != nil {
+		return nil, e
 	}
+	return openSealed(c, f)
+}
 
-	nonce := buffer[:dataFrameTagOffset]
-	tag := buffer[dataFrameTagOffset:dataFrameCipherTextOffset]
-	ciphertext := append(buffer[dataFrameCipherTextOffset:], tag...)
+// openSealed authenticates and decrypts a frame parsed by parseFrame.
+func openSealed(c *aesCipher, f *sealedFrame) ([]byte, error) {
+	if f.version != c.version {
+		return nil, fmt.Errorf("version mismatch")
+	}
+	if f.session != c.session {
+		return nil, fmt.Errorf("session mismatch")
+	}
+	if !c.replay.check(f.counter) {
+		return nil, errReplayedFrame
+	}
+	ciphertext := append(f.ciphertext[:len(f.ciphertext):len(f.ciphertext)], f.tag...)
 
-	return c.Decrypt(
+	plaintext, e := c.Decrypt(
 		aesCrypted{
 			ciphertext: ciphertext,                         // Texto cifrado + tag
-			nonce:      nonce,                              // Nonce
+			counter:    f.counter,                          // Contador del emisor
+			salt:       f.salt,                             // Sal del nonce, si la suite la usa
 			tagOffset:  len(ciphertext) - dataFrameTagSize, // Tag está al final del ciphertext
+			additional: f.header,                           // Cabecera autenticada
 		},
 	)
+	if e != nil {
+		return nil, e
+	}
+	// Only authenticated frames may move the window
+	c.replay.update(f.counter)
+	return plaintext, nil
+}
+
+// packDataFrame seals payload with the session key in a frame of msgType.
+func packDataFrame(c *aesCipher, msgType byte, payload []byte) ([]byte, error) {
+	return packFrame(c, msgType, 0, payload)
 }
 
-func dumpDataFrame(c *aesCipher, buffer []byte) ([]byte, error) {
-	a, e := c.Encrypt(buffer)
+// packFrame is packDataFrame with the flags of the frame.
+func packFrame(c *aesCipher, msgType byte, flags byte, payload []byte) ([]byte, error) {
+	counter, salt, e := c.nextNonce()
+	if e != nil {
+		return nil, e
+	}
+	f := sealedFrame{
+		msgHeader: msgHeader{c.version, msgType},
+		flags:     flags,
+		session:   c.session,
+		counter:   counter,
+		salt:      salt,
+	}
+	tagOffset := c.suite.tagOffset()
+	cipherTextOffset := c.suite.headerSize()
+	data := make([]byte, cipherTextOffset+len(payload))
+	f.encodeHeader(data)
+
+	a, e := c.Encrypt(payload, counter, salt, data[:tagOffset])
 	if e != nil {
 		return nil, e
 	}
-	data := make([]byte, len(a.ciphertext)+dataFrameNonceSize)
-	copy(data[0:dataFrameNonceSize], a.nonce)
-	copy(data[dataFrameTagOffset:dataFrameTagOffset+dataFrameTagSize], a.ciphertext[a.tagOffset:])
-	copy(data[dataFrameCipherTextOffset:], a.ciphertext[:a.tagOffset])
+	copy(data[tagOffset:cipherTextOffset], a.ciphertext[a.tagOffset:])
+	copy(data[cipherTextOffset:], a.ciphertext[:a.tagOffset])
 	return data, nil
 }
@@ -0,0 +1,133 @@
+package sdtl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Head start each address gets before the next one is tried, as in RFC 8305
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// resolveUDP looks up every address of the server and orders them the way
+// happy eyeballs does: alternating families, IPv6 first.
+func resolveUDP(to string) ([]*net.UDPAddr, error) {
+	host, service, e := net.SplitHostPort(to)
+	if e != nil {
+		return nil, e
+	}
+	port, e := net.LookupPort("udp", service)
+	if e != nil {
+		return nil, e
+	}
+	ips, e := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if e != nil {
+		return nil, e
+	}
+
+	var v4, v6 []*net.UDPAddr
+	for _, ip := range ips {
+		addr := &net.UDPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}
+		if ip.IP.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	addrs := make([]*net.UDPAddr, 0, len(ips))
+	for len(v4) > 0 || len(v6) > 0 {
+		if len(v6) > 0 {
+			addrs = append(addrs, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			addrs = append(addrs, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	return addrs, nil
+}
+
+// race runs hello against the addresses in order, starting the next one
+// whenever the previous has not finished within happyEyeballsDelay or has
+// failed, and keeps the first to get an SHS. The sockets of the others are
+// closed. All attempts send the same STR, which the server answers with the
+// same SHS, so the loser leaves no state behind.
+func (s *Socket) race(addrs []*net.UDPAddr, start *startHandShake, strPkg []byte) (*helloResult, error) {
+	type attempt struct {
+		res *helloResult
+		err error
+	}
+	var (
+		conns   []*net.UDPConn
+		lastErr error
+		next    int
+		running int
+	)
+	results := make(chan attempt, len(addrs))
+	closeAll := func(keep *net.UDPConn) {
+		for _, c := range conns {
+			if c != keep {
+				c.Close()
+			}
+		}
+	}
+	delay := time.NewTimer(0)
+	defer delay.Stop()
+
+	for {
+		select {
+		case <-delay.C:
+			if next == len(addrs) {
+				continue
+			}
+			raddr := addrs[next]
+			next++
+			network := "udp4"
+			if raddr.IP.To4() == nil {
+				network = "udp6"
+			}
+			conn, e := net.ListenUDP(network, nil)
+			if e != nil {
+				lastErr = e
+				if next < len(addrs) {
+					delay.Reset(0)
+				} else if running == 0 {
+					return nil, lastErr
+				}
+				continue
+			}
+			conns = append(conns, conn)
+			running++
+			go func() {
+				res, e := s.hello(conn, raddr, start, strPkg)
+				results <- attempt{res, e}
+			}()
+			if next < len(addrs) {
+				delay.Reset(happyEyeballsDelay)
+			}
+		case a := <-results:
+			running--
+			if a.err == nil {
+				closeAll(a.res.conn)
+				return a.res, nil
+			}
+			// Every address is the same server, which said no
+			if isRejected(a.err) {
+				closeAll(nil)
+				return nil, a.err
+			}
+			lastErr = a.err
+			if next < len(addrs) {
+				delay.Reset(0)
+			} else if running == 0 {
+				closeAll(nil)
+				return nil, lastErr
+			}
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package sdtl
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDontFragment makes the datagrams of conn go out with DF set, so those
+// larger than the path MTU are lost instead of fragmented on the way and
+// path MTU discovery sees it.
+func setDontFragment(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		// Only the option of the socket family takes
+		e4 := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_DONTFRAG, 1)
+		e6 := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, 1)
+		if e4 != nil && e6 != nil {
+			serr = e4
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
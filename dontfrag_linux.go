@@ -0,0 +1,33 @@
+package sdtl
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDontFragment makes the datagrams of conn go out with DF set, so those
+// larger than the path MTU are lost instead of fragmented on the way and
+// path MTU discovery sees it. PROBE mode also keeps the kernel from
+// shrinking them to its own idea of the path MTU. Datagrams larger than the
+// interface MTU fail to send.
+func setDontFragment(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		// Only the options of the socket family take, a dual stack
+		// socket takes both
+		e4 := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+		e6 := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+		if e4 != nil && e6 != nil {
+			serr = e4
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package sdtl
+
+import "net"
+
+// setDontFragment does nothing here: the datagrams may be fragmented on
+// the way, and path MTU discovery settles on the configured maximum.
+func setDontFragment(conn *net.UDPConn) error {
+	return nil
+}
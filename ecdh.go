@@ -1,24 +1,39 @@
 package sdtl
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/ecdh"
 	"crypto/rand"
 	"fmt"
-	"io"
+	"math"
+	"sync/atomic"
+	"time"
 )
 
 type aesCipher struct {
-	curve  ecdh.Curve
-	pk     *ecdh.PrivateKey
-	shared []byte
+	version   byte         // negotiated protocol version, written in every header
+	session   [8]byte      // written in every frame, see frameSession
+	suite     *cipherSuite // negotiated data-plane AEAD
+	curve     ecdh.Curve
+	pk        *ecdh.PrivateKey
+	shared    []byte
+	kemShared []byte // ML-KEM secret, in hybrid mode only
+	psk       []byte // mixed into the first key derivation, when configured
+	txKey     []byte
+	rxKey     []byte
+	chain     []byte
+	confirm   []byte // key of the HSD MAC
+	created   time.Time
+	bytes     atomic.Uint64
+	txCounter atomic.Uint64
+	replay    replayWindow
 }
 
 type aesCrypted struct {
 	ciphertext []byte
-	nonce      []byte
+	counter    uint64
+	salt       []byte
 	tagOffset  int
+	additional []byte // frame header, authenticated but not encrypted
 }
 
 func newCipher() (*aesCipher, error) {
@@ -50,49 +65,83 @@ func (c *aesCipher) SharedSecret(remote []byte) error {
 	return nil
 }
 
-func (c *aesCipher) Encrypt(data []byte) (aesCrypted, error) {
-	block, err := aes.NewCipher(c.shared)
-	if err != nil {
-		return aesCrypted{}, err
+// DeriveKeys replaces the raw shared secret with one key per direction. The
+// client sends with the c2s key and the server with the s2c key.
+func (c *aesCipher) DeriveKeys(salt []byte, transcript []byte, client bool) error {
+	if c.shared == nil {
+		return fmt.Errorf("shared secret not established")
+	}
+	secret := c.shared
+	if c.kemShared != nil || c.psk != nil {
+		secret = append(append(append([]byte(nil), c.shared...), c.kemShared...), c.psk...)
+		defer clear(secret)
+	}
+	c2s, s2c, chain, confirm, e := deriveSessionKeys(secret, salt, transcript)
+	if e != nil {
+		return e
 	}
+	clear(c.shared)
+	clear(c.kemShared)
+	c.shared = nil
+	c.kemShared = nil
+	c.psk = nil // not ours to clear
+	if client {
+		c.txKey, c.rxKey = c2s, s2c
+	} else {
+		c.txKey, c.rxKey = s2c, c2s
+	}
+	c.chain = chain
+	c.confirm = confirm
+	c.created = time.Now()
+	return nil
+}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return aesCrypted{}, err
+// nextNonce reserves the counter of the next frame and draws its salt, so
+// the header that carries them can be written before the frame is sealed.
+func (c *aesCipher) nextNonce() (uint64, []byte, error) {
+	counter := c.txCounter.Add(1) - 1
+	if counter == math.MaxUint64 {
+		return 0, nil, fmt.Errorf("packet counter exhausted")
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	salt := make([]byte, c.suite.saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return 0, nil, err
+	}
+	return counter, salt, nil
+}
+
+// Encrypt seals data under a counter and salt from nextNonce, along with the
+// additional data.
+func (c *aesCipher) Encrypt(data []byte, counter uint64, salt []byte, additional []byte) (aesCrypted, error) {
+	aead, err := c.suite.newAEAD(c.txKey)
+	if err != nil {
 		return aesCrypted{}, err
 	}
 
-	ciphertext := gcm.Seal(nil, nonce, data, nil)
+	c.bytes.Add(uint64(len(data)))
+	ciphertext := aead.Seal(nil, c.suite.nonce(aead.NonceSize(), salt, counter), data, additional)
 	return aesCrypted{
 		ciphertext: ciphertext,
-		nonce:      nonce,
-		tagOffset:  len(ciphertext) - gcm.Overhead(),
+		counter:    counter,
+		salt:       salt,
+		tagOffset:  len(ciphertext) - aead.Overhead(),
+		additional: additional,
 	}, nil
 }
 
 func (c *aesCipher) Decrypt(ctext aesCrypted) ([]byte, error) {
-	block, err := aes.NewCipher(c.shared)
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(block)
+	aead, err := c.suite.newAEAD(c.rxKey)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(ctext.nonce) != gcm.NonceSize() {
-		return nil, fmt.Errorf("invalid nonce size")
-	}
-
-	plaintext, err := gcm.Open(nil, ctext.nonce, ctext.ciphertext, nil)
+	nonce := c.suite.nonce(aead.NonceSize(), ctext.salt, ctext.counter)
+	plaintext, err := aead.Open(nil, nonce, ctext.ciphertext, ctext.additional)
 	if err != nil {
 		return nil, err
 	}
+	c.bytes.Add(uint64(len(plaintext)))
 
 	return plaintext, nil
 }
@@ -8,28 +8,28 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
-	"io"
 	"math/big"
-	"os"
 )
 
-func signMessage(privKey *ecdsa.PrivateKey, message []byte) ([64]byte, error) {
-	var signature [64]byte
+// signECDSA returns r||s, each left padded to 32 bytes.
+func signECDSA(privKey *ecdsa.PrivateKey, message []byte) ([]byte, error) {
+	signature := make([]byte, 64)
 
 	hash := sha256.Sum256(message)
 
 	r, s, err := ecdsa.Sign(rand.Reader, privKey, hash[:])
 	if err != nil {
-		return signature, err
+		return nil, err
 	}
 
-	copy(signature[0:32], r.Bytes())
-	copy(signature[32:64], s.Bytes())
+	// Fixed width, r or s may have leading zero bytes
+	r.FillBytes(signature[0:32])
+	s.FillBytes(signature[32:64])
 
 	return signature, nil
 }
 
-func verifySignature(pubKey *ecdsa.PublicKey, message []byte, signature [64]byte) bool {
+func verifyECDSA(pubKey *ecdsa.PublicKey, message []byte, signature []byte) bool {
 	hash := sha256.Sum256(message)
 
 	r := new(big.Int).SetBytes(signature[:32])
@@ -107,21 +107,3 @@ func UnmarshalECDSAPublicKey(pemData []byte) (*ecdsa.PublicKey, error) {
 func GenerateKey() (*ecdsa.PrivateKey, error) {
 	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 }
-
-func PrivateFromPemFile(file string) (*ecdsa.PrivateKey, error) {
-	f, e := os.Open(file)
-	if e != nil {
-		return nil, e
-	}
-	b, e := io.ReadAll(f)
-	return UnmarshalECDSAPrivateKey(b)
-}
-
-func PublicKeyFromPemFile(file string) (*ecdsa.PublicKey, error) {
-	f, e := os.Open(file)
-	if e != nil {
-		return nil, e
-	}
-	b, e := io.ReadAll(f)
-	return UnmarshalECDSAPublicKey(b)
-}
@@ -0,0 +1,34 @@
+package sdtl
+
+import (
+	"math/big"
+	"testing"
+)
+
+// About one signature in 128 has an r or s shorter than 32 bytes; those
+// must still be laid out right aligned.
+func TestSignMessageShortValues(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	short := 0
+	for i := 0; i < 2000 && short < 4; i++ {
+		msg := []byte{byte(i), byte(i >> 8)}
+		sig, err := signMessage(key, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !verifySignature(&key.PublicKey, msg, sig) {
+			t.Fatalf("signature %d does not verify", i)
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if r.BitLen() <= 248 || s.BitLen() <= 248 {
+			short++
+		}
+	}
+	if short == 0 {
+		t.Fatal("no signature with a short r or s")
+	}
+}
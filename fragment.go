@@ -0,0 +1,173 @@
+package sdtl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// A packet that does not fit in one datagram goes out as several FRG
+// frames, each sealed on its own so a forged or lost piece never spoils the
+// others. The plaintext of a FRG is the packet id, the index of the piece
+// and how many there are, followed by the piece.
+const (
+	fragmentHeaderSize = 4 + 1 + 1
+	fragmentMaxCount   = 0xff
+	// Largest packet a peer may make us put back together: the overlay MTU
+	// fragmentation lets hosts set, whatever the path carries
+	maxPacketSize = 1500
+
+	// UDP payload that crosses any IPv6 path, 1280 minus the IP and UDP
+	// headers, so nothing is lost before the path MTU is known
+	baseDatagram = 1232
+	// What an Ethernet path carries over IPv4, where discovery stops
+	DefaultMaxDatagram = 1500 - 20 - 8
+	minDatagram        = 256
+	maxDatagram        = 2048 // size of the receive buffers
+
+	// Reassembly is bounded per session: in packets and bytes waiting, and
+	// in how long a packet may wait for its missing pieces
+	reassemblyMaxPackets = 16
+	reassemblyMaxBytes   = reassemblyMaxPackets * maxPacketSize
+	reassemblyTimeout    = 2 * time.Second
+)
+
+func checkDatagram(size int) error {
+	if size < minDatagram || size > maxDatagram {
+		return fmt.Errorf("datagram size must be between %d and %d", minDatagram, maxDatagram)
+	}
+	return nil
+}
+
+// sealPacket seals packet in a DFE if it fits in datagram bytes, or in as
+// many FRG as it takes when fragmentation was negotiated. Every frame gets
+// flags, which describe the whole packet.
+func sealPacket(c *aesCipher, caps uint32, flags byte, id uint32, packet []byte, datagram int) ([][]byte, error) {
+	room := datagram - c.suite.headerSize()
+	if len(packet) <= room {
+		frame, e := packFrame(c, msgDFE, flags, packet)
+		if e != nil {
+			return nil, e
+		}
+		return [][]byte{frame}, nil
+	}
+	if caps&capFragment == 0 {
+		return nil, fmt.Errorf("packet of %d bytes does not fit in %d", len(packet), datagram)
+	}
+	room -= fragmentHeaderSize
+	count := (len(packet) + room - 1) / room
+	if len(packet) > maxPacketSize || count > fragmentMaxCount {
+		return nil, fmt.Errorf("packet too large: %d bytes", len(packet))
+	}
+	frames := make([][]byte, 0, count)
+	piece := make([]byte, fragmentHeaderSize+room)
+	binary.BigEndian.PutUint32(piece, id)
+	piece[5] = byte(count)
+	for i := 0; i < count; i++ {
+		piece[4] = byte(i)
+		n := copy(piece[fragmentHeaderSize:], packet[i*room:])
+		frame, e := packFrame(c, msgFRG, flags, piece[:fragmentHeaderSize+n])
+		if e != nil {
+			return nil, e
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+type partialPacket struct {
+	pieces  [][]byte
+	missing int
+	size    int
+	started time.Time
+}
+
+// reassembly holds the packets of a session that are still missing pieces.
+type reassembly struct {
+	packets map[uint32]*partialPacket
+	bytes   int
+}
+
+// add takes the plaintext of a FRG and returns the whole packet once its
+// last piece arrives. Packets that waited too long are dropped, and so is
+// the oldest one when the limits would be passed.
+func (r *reassembly) add(fragment []byte, now time.Time) ([]byte, error) {
+	if len(fragment) <= fragmentHeaderSize {
+		return nil, errShortMessage
+	}
+	id := binary.BigEndian.Uint32(fragment)
+	index, count := int(fragment[4]), int(fragment[5])
+	piece := fragment[fragmentHeaderSize:]
+	if count < 2 || index >= count {
+		return nil, fmt.Errorf("%w: fragment %d of %d", errMalformed, index, count)
+	}
+	r.expire(now)
+	if r.packets == nil {
+		r.packets = make(map[uint32]*partialPacket)
+	}
+	p, ok := r.packets[id]
+	if !ok {
+		for len(r.packets) >= reassemblyMaxPackets || (len(r.packets) > 0 && r.bytes+len(piece) > reassemblyMaxBytes) {
+			r.dropOldest()
+		}
+		p = &partialPacket{
+			pieces:  make([][]byte, count),
+			missing: count,
+			started: now,
+		}
+		r.packets[id] = p
+	}
+	if len(p.pieces) != count {
+		r.drop(id)
+		return nil, fmt.Errorf("fragment count mismatch")
+	}
+	if p.pieces[index] != nil {
+		return nil, nil
+	}
+	if p.size+len(piece) > maxPacketSize {
+		r.drop(id)
+		return nil, fmt.Errorf("packet too large")
+	}
+	p.pieces[index] = append([]byte(nil), piece...)
+	p.missing--
+	p.size += len(piece)
+	r.bytes += len(piece)
+	if p.missing > 0 {
+		return nil, nil
+	}
+	packet := make([]byte, 0, p.size)
+	for _, b := range p.pieces {
+		packet = append(packet, b...)
+	}
+	r.drop(id)
+	return packet, nil
+}
+
+// expire drops the packets that have waited longer than reassemblyTimeout.
+func (r *reassembly) expire(now time.Time) {
+	for id, p := range r.packets {
+		if now.Sub(p.started) > reassemblyTimeout {
+			r.drop(id)
+		}
+	}
+}
+
+func (r *reassembly) dropOldest() {
+	var (
+		oldest uint32
+		first  time.Time
+	)
+	for id, p := range r.packets {
+		if first.IsZero() || p.started.Before(first) {
+			oldest, first = id, p.started
+		}
+	}
+	r.drop(oldest)
+}
+
+func (r *reassembly) drop(id uint32) {
+	if p, ok := r.packets[id]; ok {
+		r.bytes -= p.size
+		delete(r.packets, id)
+	}
+}
@@ -0,0 +1,85 @@
+package sdtl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReassemblyLimit(t *testing.T) {
+	piece := func(index int, size int) []byte {
+		f := make([]byte, fragmentHeaderSize+size)
+		binary.BigEndian.PutUint32(f, 7)
+		f[4] = byte(index)
+		f[5] = 2
+		return f
+	}
+	var r reassembly
+	now := time.Now()
+	if p, err := r.add(piece(0, maxPacketSize/2+1), now); p != nil || err != nil {
+		t.Fatalf("first piece: %v", err)
+	}
+	if p, err := r.add(piece(1, maxPacketSize/2), now); p != nil || err == nil {
+		t.Fatal("a packet larger than maxPacketSize must not be put back together")
+	}
+	if p, err := r.add(piece(0, 100), now); p != nil || err != nil {
+		t.Fatalf("first piece again: %v", err)
+	}
+	if p, err := r.add(piece(1, 100), now); len(p) != 200 || err != nil {
+		t.Fatalf("reassembled %d bytes: %v", len(p), err)
+	}
+
+	c, _ := testSession(t, cipherSuites[0])
+	if _, err := sealPacket(c.key, capFragment, 0, 1, make([]byte, maxPacketSize+1), baseDatagram); err == nil {
+		t.Fatal("a packet larger than maxPacketSize must not be sent")
+	}
+}
+
+// A packet larger than the buffer of Read is dropped, and the session goes
+// on with the next one.
+func TestSocketReadDropsOversized(t *testing.T) {
+	s, err := NewSocketClientPSK(bytes.Repeat([]byte{7}, pskMinSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.conn.Close()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	client, server := testSession(t, cipherSuites[0])
+	s.raddr = peer.LocalAddr().(*net.UDPAddr)
+	s.encrypt = client.key
+	s.version = client.key.version
+	s.caps = capFragment | capSuiteAESGCM
+	s.channels = newChannelSet(s, nil, 1, make(chan *Channel, channelQueue))
+	s.main = s.channels.add(0)
+
+	for i, size := range []int{1400, 100} {
+		frames, err := sealPacket(server.key, s.caps, 0, uint32(i), bytes.Repeat([]byte{byte(i)}, size), baseDatagram)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, frame := range frames {
+			if _, err := peer.WriteToUDP(frame, s.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	s.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1000)
+	n, err := s.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 100 || buf[0] != 1 {
+		t.Fatalf("read %d bytes of packet %d", n, buf[0])
+	}
+}
@@ -1,3 +1,9 @@
 module sdtl
 
-go 1.22.4
+go 1.24.0
+
+require (
+	golang.org/x/crypto v0.44.0
+	golang.org/x/net v0.47.0
+	golang.org/x/sys v0.38.0
+)
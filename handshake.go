@@ -1,110 +1,392 @@
 package sdtl
 
 import (
-	"crypto/ecdsa"
+	"bytes"
+	"crypto"
 	"fmt"
+	"math"
 	"net"
+	"time"
 )
 
 const (
-	ProtocolVer = 0xDF
+	// ProtocolVer goes up with every change to the layout or the meaning of
+	// a message, so that peers built from different trees fail to negotiate
+	// instead of misreading each other.
+	ProtocolVer = 0xED
+	// protocolVerPrev is the version ProtocolVer replaced. It is still
+	// spoken for one release, so clients and servers can be upgraded one at
+	// a time; the differences are dealt with next to the message, see
+	// unknownSession.
+	protocolVerPrev = 0xEC
 
 	msgSTR = 0x01
 	msgSHS = 0x02
 	msgCHS = 0x03
+	msgRKQ = 0x04
+	msgRKS = 0x05
+	msgHVR = 0x06
+	msgHSD = 0x07
+	msgCLS = 0x08
+	msgKAL = 0x09
+	msgFRG = 0x0a
+	msgPRB = 0x0b
+	msgPRA = 0x0c
+	msgREJ = 0x0d
+	msgUSN = 0x0e
 	msgDFE = 0xaa
 
-	sizeXHS      = 8 + 65 + 64
-	xhsEPKOffset = 8
-	xhsSigOffset = 73
-	sizeSTR      = 76
-	strSesOffset = 4
-	strSigOffset = 12
+	// Sizes and offsets leave out the signature, whose length depends on the
+	// type of the key that made it, see signatureSize
+	xhsVerOffset = 8
+	xhsCapOffset = 9
+	xhsEPKOffset = 13
+	xhsSigOffset = 78
+	strSesOffset = 16
+	strTimOffset = 24
+	strVerOffset = 32
+	strSigOffset = 32 + 1 + 4 // without the version list
+	strMinSize   = 32 + 1 + 1 + 4
+	maxVersions  = 8
+	hsdHshOffset = 8
+	hsdMACOffset = 40
+	hsdSigOffset = 72
+	rejRsnOffset = 8
+	rejSigOffset = 9
 )
 
+// How far a STR timestamp may be from the server clock, either way
+const DefaultHandshakeSkew = 30 * time.Second
+
+// Capabilities announced in STR and settled in SHS. The low byte holds
+// optional features, the next one the data-plane cipher suites, of which
+// exactly one ends up selected.
+const (
+	capRekey    = 1 << 0
+	capCookie   = 1 << 1
+	capHybrid   = 1 << 2 // ML-KEM-768 next to ECDH, see hybrid.go
+	capCert     = 1 << 3 // the STR carries a host certificate, see cert.go
+	capFragment = 1 << 4 // packets larger than a datagram, see fragment.go
+	capPMTU     = 1 << 5 // path MTU discovery, see pmtu.go
+	capChannel  = 1 << 6 // channels besides the main pipe, see channel.go
+
+	capSuiteAESGCM    = 1 << 8
+	capSuiteChaCha20  = 1 << 9
+	capSuiteXChaCha20 = 1 << 10
+	capSuites         = 0xff << 8
+
+	supportedCaps = capRekey | capCookie | capHybrid | capCert | capFragment | capPMTU |
+		capChannel | capSuiteAESGCM | capSuiteChaCha20 | capSuiteXChaCha20
+)
+
+// supportedVersions lists the versions this implementation speaks, most
+// preferred first. STR always carries the whole list.
+var supportedVersions = []byte{ProtocolVer, protocolVerPrev}
+
+// suitePreference is the order in which the server picks a cipher suite.
+var suitePreference = []uint32{capSuiteAESGCM, capSuiteChaCha20, capSuiteXChaCha20}
+
+func isSupportedVersion(v byte) bool {
+	return bytes.IndexByte(supportedVersions, v) >= 0
+}
+
+// replyVersion is the version to answer the STR in msg with before any is
+// negotiated: the one it came in, which the client is sure to speak, if we
+// speak it too.
+func replyVersion(msg *IOMessage) byte {
+	if v := msg.buffer[0]; isSupportedVersion(v) {
+		return v
+	}
+	return ProtocolVer
+}
+
+// negotiate picks the highest version both sides speak and the common
+// capabilities, reduced to a single cipher suite.
+func negotiate(offered []byte, caps uint32) (byte, uint32, error) {
+	var version byte
+	for _, v := range supportedVersions {
+		if bytes.IndexByte(offered, v) >= 0 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return 0, 0, fmt.Errorf("no common protocol version in %x", offered)
+	}
+	common := caps & supportedCaps
+	for _, suite := range suitePreference {
+		if common&suite != 0 {
+			return version, common&^capSuites | suite, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("no common cipher suite in %08x", caps)
+}
+
+// checkNegotiated is the client side of negotiate: what the server chose
+// must come from our own offer, with exactly one cipher suite.
+func checkNegotiated(offered []byte, caps uint32, version byte, chosen uint32) error {
+	if bytes.IndexByte(offered, version) < 0 {
+		return fmt.Errorf("server chose a version not offered: %x", version)
+	}
+	if chosen&^caps != 0 {
+		return fmt.Errorf("server chose capabilities not offered: %08x", chosen)
+	}
+	suite := chosen & capSuites
+	if suite == 0 || suite&(suite-1) != 0 {
+		return fmt.Errorf("server chose an invalid cipher suite: %08x", chosen)
+	}
+	return nil
+}
+
 type handShakeInterface interface {
-	dump(*ecdsa.PrivateKey) ([]byte, error)
-	load(*ecdsa.PublicKey, []byte) error
+	dump(crypto.Signer) ([]byte, error)
+	load(crypto.PublicKey, []byte) error
 	size() int
 }
 
+// startHandShake is the client hello. Its signature covers the offered
+// versions and capabilities, so they cannot be stripped to force a downgrade,
+// and the time it was made, so a recorded one cannot be replayed later.
 type startHandShake struct {
-	ip        [4]byte
+	ip        [16]byte // IPv4 addresses in their IPv4-mapped form
 	session   [8]byte
-	signature [64]byte
+	timestamp uint64 // seconds since the epoch
+	versions  []byte
+	caps      uint32
+	ek        []byte // ML-KEM encapsulation key, when caps has capHybrid
+	cert      []byte // host certificate, when caps has capCert
+	signature []byte
 }
 
+// handShake is both SHS and CHS: the server states the version and
+// capabilities it chose and the client repeats them.
 type handShake struct {
 	session   [8]byte
+	version   byte
+	caps      uint32
 	epk       [65]byte
-	signature [64]byte
+	kem       []byte // ML-KEM ciphertext, in a hybrid SHS only
+	signature []byte
+}
+
+// handShakeDone is the server confirmation that CHS arrived and the session
+// is ready. It signs the hash of the whole transcript, so the client knows
+// both sides derived their keys from the same messages, and a MAC of it
+// under the new keys, so a wrong PSK fails the handshake.
+type handShakeDone struct {
+	session    [8]byte
+	transcript [32]byte
+	mac        [32]byte
+	signature  []byte
+}
+
+// handShakeReject is the server answer to a STR it refuses, see reject.go.
+type handShakeReject struct {
+	session   [8]byte
+	reason    byte
+	signature []byte
 }
 
 func extractIP(buf []byte) net.IP {
-	return net.IPv4(buf[0], buf[1], buf[2], buf[3])
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, buf[:net.IPv6len])
+	return ip
 }
 
-func (hs *startHandShake) dump(pk *ecdsa.PrivateKey) ([]byte, error) {
-	var e error
-	buf := make([]byte, sizeSTR)
+// strBodySize returns the length of the signed part of the STR at the start
+// of data, or 0 if it is malformed.
+func strBodySize(data []byte) int {
+	var hs startHandShake
+	size, e := hs.decode(data, 0)
+	if e != nil {
+		return 0
+	}
+	return size
+}
+
+// strSize returns the length of the STR at the start of data, signed with
+// a key whose signatures are sigSize long, without checking the signature,
+// or 0 if it is malformed.
+func strSize(data []byte, sigSize int) int {
+	var hs startHandShake
+	if sigSize == 0 {
+		return 0
+	}
+	size, e := hs.decode(data, sigSize)
+	if e != nil {
+		return 0
+	}
+	return size
+}
+
+// strKey returns the key that must have signed the STR: the one in its
+// certificate, if any, or else the one of the host.
+func strKey(hs *startHandShake, host *connection) crypto.PublicKey {
+	if hs.cert != nil {
+		c, _, _, e := parseCertificate(hs.cert)
+		if e != nil {
+			return nil
+		}
+		return c.PublicKey
+	}
+	if host == nil {
+		return nil
+	}
+	return host.publicKey
+}
 
-	copy(buf[0:strSesOffset], hs.ip[:])
-	copy(buf[strSesOffset:strSigOffset], hs.session[:])
-	hs.signature, e = signMessage(pk, buf[0:strSigOffset])
+func (hs *startHandShake) dump(pk crypto.Signer) ([]byte, error) {
+	buf, e := hs.encode()
+	if e != nil {
+		return nil, e
+	}
+	hs.signature, e = signMessage(pk, buf)
 	if e != nil {
 		return nil, fmt.Errorf("at signing start handshake %w", e)
 	}
-	copy(buf[strSigOffset:], hs.signature[:])
-	return buf, nil
+	return append(buf, hs.signature...), nil
 }
 
-func (hs *startHandShake) load(pk *ecdsa.PublicKey, data []byte) error {
+func (hs *startHandShake) load(pk crypto.PublicKey, data []byte) error {
+	sigSize := signatureSize(pk)
+	if sigSize == 0 {
+		return fmt.Errorf("invalid key")
+	}
+	size, e := hs.decode(data, sigSize)
+	if e != nil {
+		return e
+	}
+	if !verifySignature(pk, data[:size-sigSize], hs.signature) {
+		return errInvalidSignature
+	}
+	return nil
+}
 
-	if len(data) < sizeSTR {
-		return fmt.Errorf("invalid data size")
+// checkTimestamp rejects a STR made more than skew away from now.
+func (hs *startHandShake) checkTimestamp(now time.Time, skew time.Duration) error {
+	if hs.timestamp > math.MaxInt64 {
+		return fmt.Errorf("invalid timestamp")
 	}
-	copy(hs.ip[:], data[:strSesOffset])
-	copy(hs.session[:], data[strSesOffset:strSigOffset])
-	copy(hs.signature[:], data[strSigOffset:sizeSTR])
-	valid := verifySignature(pk, data[0:strSigOffset], hs.signature)
-	if !valid {
-		return fmt.Errorf("invalid signature")
+	made := time.Unix(int64(hs.timestamp), 0)
+	if made.Before(now.Add(-skew)) || made.After(now.Add(skew)) {
+		return fmt.Errorf("timestamp out of window: %s", made.UTC().Format(time.RFC3339))
 	}
 	return nil
 }
 
 func (hs *startHandShake) size() int {
-	return sizeSTR
+	size := strSigOffset + len(hs.versions) + len(hs.ek) + len(hs.signature)
+	if len(hs.cert) != 0 {
+		size += 2 + len(hs.cert)
+	}
+	return size
 }
 
-func (hs *handShake) dump(pk *ecdsa.PrivateKey) ([]byte, error) {
-	var e error
-	buf := make([]byte, sizeXHS)
-	copy(buf, hs.session[:])
-	copy(buf[xhsEPKOffset:], hs.epk[:])
-	hs.signature, e = signMessage(pk, buf[0:xhsSigOffset])
+func (hs *handShake) dump(pk crypto.Signer) ([]byte, error) {
+	buf, e := hs.encode()
+	if e != nil {
+		return nil, e
+	}
+	hs.signature, e = signMessage(pk, buf)
 	if e != nil {
 		return nil, fmt.Errorf("at signing handshake %w", e)
 	}
-	copy(buf[xhsSigOffset:], hs.signature[:])
-	return buf, nil
+	return append(buf, hs.signature...), nil
 }
 
-func (hs *handShake) load(pk *ecdsa.PublicKey, data []byte) error {
-
-	if len(data) < sizeXHS {
-		return fmt.Errorf("invalid data size")
+func (hs *handShake) load(pk crypto.PublicKey, data []byte) error {
+	sigSize := signatureSize(pk)
+	e := hs.decode(data, sigSize)
+	if e != nil {
+		return e
 	}
-	copy(hs.session[:], data[:xhsEPKOffset])
-	copy(hs.epk[:], data[xhsEPKOffset:xhsSigOffset])
-	copy(hs.signature[:], data[xhsSigOffset:sizeXHS])
-	valid := verifySignature(pk, data[0:xhsSigOffset], hs.signature)
-	if !valid {
-		return fmt.Errorf("invalid signature")
+	if !verifySignature(pk, data[:len(data)-sigSize], hs.signature) {
+		return errInvalidSignature
 	}
 	return nil
 }
 
 func (hs *handShake) size() int {
-	return sizeXHS
+	return xhsSigOffset + len(hs.kem) + len(hs.signature)
+}
+
+func (hs *handShakeDone) dump(pk crypto.Signer) ([]byte, error) {
+	var e error
+	buf := hs.encode()
+	hs.signature, e = signMessage(pk, buf)
+	if e != nil {
+		return nil, fmt.Errorf("at signing handshake done %w", e)
+	}
+	return append(buf, hs.signature...), nil
+}
+
+func (hs *handShakeDone) load(pk crypto.PublicKey, data []byte) error {
+	sigSize := signatureSize(pk)
+	e := hs.decode(data, sigSize)
+	if e != nil {
+		return e
+	}
+	if !verifySignature(pk, data[:hsdSigOffset], hs.signature) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+func (hs *handShakeDone) size() int {
+	return hsdSigOffset + len(hs.signature)
+}
+
+func (hs *handShakeReject) dump(pk crypto.Signer) ([]byte, error) {
+	var e error
+	buf := hs.encode()
+	hs.signature, e = signMessage(pk, buf)
+	if e != nil {
+		return nil, fmt.Errorf("at signing reject %w", e)
+	}
+	return append(buf, hs.signature...), nil
+}
+
+func (hs *handShakeReject) load(pk crypto.PublicKey, data []byte) error {
+	sigSize := signatureSize(pk)
+	e := hs.decode(data, sigSize)
+	if e != nil {
+		return e
+	}
+	if !verifySignature(pk, data[:rejSigOffset], hs.signature) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+func (hs *handShakeReject) size() int {
+	return rejSigOffset + len(hs.signature)
+}
+
+func (hs *unknownSession) dump(pk crypto.Signer) ([]byte, error) {
+	var e error
+	buf := hs.encode()
+	hs.signature, e = signMessage(pk, buf)
+	if e != nil {
+		return nil, fmt.Errorf("at signing unknown session %w", e)
+	}
+	return append(buf, hs.signature...), nil
+}
+
+func (hs *unknownSession) load(pk crypto.PublicKey, data []byte) error {
+	sigSize := signatureSize(pk)
+	if sigSize == 0 {
+		return fmt.Errorf("invalid key")
+	}
+	e := hs.decode(data, sigSize)
+	if e != nil {
+		return e
+	}
+	if !verifySignature(pk, data[:hs.bodySize()], hs.signature) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+func (hs *unknownSession) size() int {
+	return hs.bodySize() + len(hs.signature)
 }
@@ -0,0 +1,109 @@
+package sdtl
+
+import (
+	"bytes"
+	"crypto"
+	"testing"
+)
+
+// A client of the previous release still gets a session, and one of this
+// release gets the current version from either.
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		offered []byte
+		want    byte
+	}{
+		{supportedVersions, ProtocolVer},
+		{[]byte{protocolVerPrev}, protocolVerPrev},
+		{[]byte{ProtocolVer + 1, protocolVerPrev}, protocolVerPrev},
+		{[]byte{protocolVerPrev - 1}, 0},
+	}
+	for _, tt := range tests {
+		version, caps, err := negotiate(tt.offered, capSuiteAESGCM)
+		if tt.want == 0 {
+			if err == nil {
+				t.Fatalf("negotiate(%x) = %x, want an error", tt.offered, version)
+			}
+			continue
+		}
+		if err != nil || version != tt.want || caps != capSuiteAESGCM {
+			t.Fatalf("negotiate(%x) = %x, %08x, %v", tt.offered, version, caps, err)
+		}
+		if err := checkNegotiated(tt.offered, capSuiteAESGCM, version, caps); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Under protocolVerPrev the USN has no address, in the echo as in the
+// signed notice.
+func TestUnknownSessionVersions(t *testing.T) {
+	key, err := GenerateSigner(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range supportedVersions {
+		usn := unknownSession{version: version, session: createRandomSession()}
+		copy(usn.ip[:], []byte{0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2})
+		data, err := packHandShakeMessage(key, version, msgUSN, &usn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := unknownSession{version: version}
+		if err := got.load(key.Public(), data[msgHeaderSize:]); err != nil {
+			t.Fatalf("%x: %v", version, err)
+		}
+		if got.session != usn.session {
+			t.Fatalf("%x: session changed", version)
+		}
+		hasIP := !bytes.Equal(got.ip[:], make([]byte, 16))
+		if hasIP != (version != protocolVerPrev) {
+			t.Fatalf("%x: address %x", version, got.ip)
+		}
+		other := unknownSession{version: supportedVersions[0]}
+		if version == supportedVersions[0] {
+			other.version = supportedVersions[1]
+		}
+		if other.load(key.Public(), data[msgHeaderSize:]) == nil {
+			t.Fatalf("%x: notice read as another version", version)
+		}
+	}
+}
+
+// Everything the server sends fits baseDatagram, since its sockets set DF
+// from the start; only the client STR may be larger.
+func TestServerMessageSizes(t *testing.T) {
+	ecdsa, err := GenerateSigner(KeyTypeECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed, err := GenerateSigner(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psk, _ := pskKeys(make([]byte, pskMinSize), false)
+	for _, key := range []crypto.Signer{ecdsa, ed, psk} {
+		msgs := []struct {
+			msgType uint
+			msg     handShakeInterface
+		}{
+			{msgSHS, &handShake{caps: capHybrid, kem: make([]byte, sizeKEMCT)}},
+			{msgSHS, &handShake{}},
+			{msgHSD, &handShakeDone{}},
+			{msgREJ, &handShakeReject{}},
+			{msgUSN, &unknownSession{version: ProtocolVer}},
+		}
+		for _, m := range msgs {
+			data, err := packHandShakeMessage(key, ProtocolVer, m.msgType, m.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) > baseDatagram {
+				t.Fatalf("%T message %x: %d bytes", key, m.msgType, len(data))
+			}
+		}
+	}
+	if size := msgHeaderSize + sizeHVR; size > baseDatagram {
+		t.Fatalf("HVR: %d bytes", size)
+	}
+}
@@ -0,0 +1,40 @@
+package sdtl
+
+import (
+	"crypto/mlkem"
+	"fmt"
+)
+
+// In hybrid mode the client sends an ML-KEM-768 encapsulation key in its STR
+// and the server answers with a ciphertext in its SHS, next to the usual
+// P-256 exchange. Both secrets feed the key derivation, so the session stays
+// confidential unless both are broken. Only the first handshake is hybrid:
+// a rekey is plain ECDH, but it is salted with the chain key and so inherits
+// the ML-KEM secret.
+const (
+	sizeKEMKey = mlkem.EncapsulationKeySize768
+	sizeKEMCT  = mlkem.CiphertextSize768
+)
+
+// encapsulate is the server half: it derives the ML-KEM secret for the
+// client key ek and returns the ciphertext that lets the client do the same.
+func (c *aesCipher) encapsulate(ek []byte) ([]byte, error) {
+	key, e := mlkem.NewEncapsulationKey768(ek)
+	if e != nil {
+		return nil, fmt.Errorf("invalid encapsulation key: %w", e)
+	}
+	shared, ct := key.Encapsulate()
+	c.kemShared = shared
+	return ct, nil
+}
+
+// decapsulate is the client half, with the key whose public part went in
+// the STR.
+func (c *aesCipher) decapsulate(dk *mlkem.DecapsulationKey768, ct []byte) error {
+	shared, e := dk.Decapsulate(ct)
+	if e != nil {
+		return fmt.Errorf("invalid ciphertext: %w", e)
+	}
+	c.kemShared = shared
+	return nil
+}
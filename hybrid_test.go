@@ -0,0 +1,76 @@
+package sdtl
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"testing"
+)
+
+func TestHybridKeys(t *testing.T) {
+	client, err := newCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := server.encapsulate(dk.EncapsulationKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ct) != sizeKEMCT {
+		t.Fatalf("ciphertext size %d", len(ct))
+	}
+	if err := client.decapsulate(dk, ct); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SharedSecret(server.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SharedSecret(client.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	session := createRandomSession()
+	transcript := transcriptHash([]byte("STR"), []byte("SHS"), []byte("CHS"))
+	plain, _, _, _, err := deriveSessionKeys(client.shared, session[:], transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DeriveKeys(session[:], transcript, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.DeriveKeys(session[:], transcript, false); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(client.txKey, server.rxKey) || !bytes.Equal(client.rxKey, server.txKey) {
+		t.Fatal("both ends must agree on the hybrid keys")
+	}
+	if bytes.Equal(client.txKey, plain) {
+		t.Fatal("the ML-KEM secret must change the keys")
+	}
+	if client.kemShared != nil || server.kemShared != nil {
+		t.Fatal("the ML-KEM secret must be dropped once used")
+	}
+}
+
+func TestHybridInvalid(t *testing.T) {
+	c, err := newCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.encapsulate(make([]byte, sizeKEMKey-1)); err == nil {
+		t.Fatal("short encapsulation key accepted")
+	}
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.decapsulate(dk, make([]byte, sizeKEMCT+1)); err == nil {
+		t.Fatal("long ciphertext accepted")
+	}
+}
@@ -0,0 +1,57 @@
+package sdtl
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+const (
+	sessionKeySize = 32
+
+	kdfLabelC2S   = "sdtl key c2s"
+	kdfLabelS2C   = "sdtl key s2c"
+	kdfLabelChain = "sdtl chain"
+	kdfLabelConf  = "sdtl confirm"
+)
+
+// transcriptHash digests the handshake messages exactly as they were sent
+// on the wire, header included, in the order STR, SHS, CHS.
+func transcriptHash(msgs ...[]byte) []byte {
+	h := sha256.New()
+	for _, m := range msgs {
+		h.Write(m)
+	}
+	return h.Sum(nil)
+}
+
+// deriveSessionKeys runs HKDF-SHA256 over the ECDH output, followed by the
+// ML-KEM secret in hybrid mode and the PSK when there is one, using salt and
+// the transcript hash as context, so the keys are bound to both. The salt is
+// the session on the first handshake and the previous chain key on a rekey;
+// the returned chain key seeds the next rekey, and the confirmation key
+// proves to the client that the server derived the same keys, see
+// confirmKeys.
+func deriveSessionKeys(shared []byte, salt []byte, transcript []byte) ([]byte, []byte, []byte, []byte, error) {
+	prk, e := hkdf.Extract(sha256.New, shared, salt)
+	if e != nil {
+		return nil, nil, nil, nil, e
+	}
+	var keys [4][]byte
+	for i, label := range []string{kdfLabelC2S, kdfLabelS2C, kdfLabelChain, kdfLabelConf} {
+		keys[i], e = hkdf.Expand(sha256.New, prk, label+string(transcript), sessionKeySize)
+		if e != nil {
+			return nil, nil, nil, nil, e
+		}
+	}
+	return keys[0], keys[1], keys[2], keys[3], nil
+}
+
+// confirmKeys returns the MAC the HSD carries over the transcript hash. The
+// signature of the HSD says who sent it; the MAC says it knew the secrets,
+// the PSK included, that went into the session keys.
+func confirmKeys(key []byte, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,46 @@
+package sdtl
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeriveSessionKeys(t *testing.T) {
+	shared := bytes.Repeat([]byte{1}, 32)
+	salt := []byte("session!")
+	transcript := transcriptHash([]byte("STR"), []byte("SHS"), []byte("CHS"))
+	c2s, s2c, chain, confirm, err := deriveSessionKeys(shared, salt, transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range [][]byte{c2s, s2c, chain, confirm} {
+		if len(k) != sessionKeySize {
+			t.Fatalf("key size %d", len(k))
+		}
+	}
+	if bytes.Equal(c2s, s2c) || bytes.Equal(c2s, chain) || bytes.Equal(s2c, chain) || bytes.Equal(chain, confirm) {
+		t.Fatal("every label must give its own key")
+	}
+	again, _, _, _, _ := deriveSessionKeys(shared, salt, transcript)
+	if !bytes.Equal(c2s, again) {
+		t.Fatal("the derivation must be deterministic")
+	}
+	tests := []struct {
+		name                     string
+		shared, salt, transcript []byte
+	}{
+		{"secret", append(shared[:31:31], 2), salt, transcript},
+		{"psk", append(shared, 3), salt, transcript},
+		{"salt", shared, []byte("session?"), transcript},
+		{"transcript", shared, salt, transcriptHash([]byte("STR"), []byte("SHS"))},
+	}
+	for _, tt := range tests {
+		other, _, _, _, err := deriveSessionKeys(tt.shared, tt.salt, tt.transcript)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(c2s, other) {
+			t.Fatalf("a different %s must give different keys", tt.name)
+		}
+	}
+}
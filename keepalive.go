@@ -0,0 +1,90 @@
+package sdtl
+
+import "time"
+
+const (
+	// Below the usual NAT UDP timeout, and well below DefaultIdleTimeout
+	DefaultKeepalive        = 25 * time.Second
+	DefaultIdleTimeout      = 2 * time.Minute
+	DefaultHandshakeTimeout = 10 * time.Second
+)
+
+// SetKeepalive sets how often the socket sends a KAL, an empty frame sealed
+// with the session key, so the server does not reap the session and NAT
+// mappings on the way stay open. It takes effect on the next Connect; zero
+// disables it.
+func (s *Socket) SetKeepalive(every time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keepalive = every
+}
+
+// startKeepalive runs the keepalive loop for the session just established.
+func (s *Socket) startKeepalive() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keepalive <= 0 || s.encrypt == nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	go s.keepaliveLoop(s.stop, s.keepalive)
+}
+
+func (s *Socket) keepaliveLoop(stop <-chan struct{}, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		encrypt := s.encrypt
+		conn, raddr := s.conn, s.raddr
+		s.mu.Unlock()
+		if encrypt == nil {
+			return
+		}
+		data, err := packDataFrame(encrypt, msgKAL, nil)
+		if err != nil {
+			continue
+		}
+		conn.WriteToUDP(data, raddr)
+	}
+}
+
+// reapSessions closes ready sessions that have been silent for longer than
+// the idle timeout, or whose certificate expired, telling the peer with a
+// CLS, and forgets handshakes the client never completed.
+func (s *Server) reapSessions(send chan<- *IOMessage) {
+	ct := getConnTable()
+	now := time.Now()
+	for _, conn := range ct.private {
+		switch conn.state {
+		case ConnectionReady:
+			expired := conn.certified && now.After(conn.certExpires)
+			if now.Sub(conn.mtime) < s.idleTimeout && !expired {
+				continue
+			}
+			if expired {
+				log("INFO: Certificate expired, closing: %s", conn.priAddr.String())
+			} else {
+				log("INFO: Session idle, closing: %s", conn.priAddr.String())
+			}
+			if conn.encrypt != nil && conn.pubAddr != nil {
+				if msg, e := closeMessage(conn); e == nil {
+					send <- msg
+				}
+			}
+		case HandShakeServerSent:
+			if now.Sub(conn.mtime) < s.handshakeTimeout {
+				continue
+			}
+			log("INFO: Handshake timeout: %s", conn.priAddr.String())
+		default:
+			continue
+		}
+		ct.close(conn)
+	}
+}
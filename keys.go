@@ -0,0 +1,174 @@
+package sdtl
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// Identity key types, as taken by GenerateSigner and returned by KeyType.
+const (
+	KeyTypeECDSA   = "ecdsa" // over P-256
+	KeyTypeEd25519 = "ed25519"
+)
+
+// signatureSize is the length of the handshake signatures made by the
+// private half of pub, 0 when the key type is not supported.
+func signatureSize(pub crypto.PublicKey) int {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return 64
+		}
+	case ed25519.PublicKey:
+		return ed25519.SignatureSize
+	case pskMAC:
+		return sha256.Size
+	}
+	return 0
+}
+
+func signMessage(key crypto.Signer, message []byte) ([]byte, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		return signECDSA(k, message)
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, message), nil
+	case pskMAC:
+		return k.mac(message), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+func verifySignature(pub crypto.PublicKey, message []byte, signature []byte) bool {
+	if len(signature) == 0 || len(signature) != signatureSize(pub) {
+		return false
+	}
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return verifyECDSA(k, message, signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, message, signature)
+	case pskMAC:
+		return hmac.Equal(k.mac(message), signature)
+	}
+	return false
+}
+
+// KeyType returns the type of an identity key, public or private, or "" if
+// the handshake cannot use it.
+func KeyType(key any) string {
+	if signer, ok := key.(crypto.Signer); ok {
+		key = signer.Public()
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey:
+		if signatureSize(key) != 0 {
+			return KeyTypeECDSA
+		}
+	case ed25519.PublicKey:
+		return KeyTypeEd25519
+	}
+	return ""
+}
+
+// GenerateSigner creates an identity key of the given type.
+func GenerateSigner(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeECDSA:
+		return GenerateKey()
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unknown key type: %s", keyType)
+}
+
+// MarshalPrivateKey serializes an identity key into PKCS#8 PEM.
+func MarshalPrivateKey(key crypto.Signer) ([]byte, error) {
+	if KeyType(key) == "" {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// UnmarshalPrivateKey reads an identity key from PKCS#8 PEM, or from the
+// SEC 1 PEM that MarshalECDSAPrivateKey writes, whatever its type.
+func UnmarshalPrivateKey(pemData []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM block containing private key")
+	}
+	if block.Type == "EC PRIVATE KEY" {
+		return UnmarshalECDSAPrivateKey(pemData)
+	}
+	if block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("unexpected PEM block: %s", block.Type)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok || KeyType(signer) == "" {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// MarshalPublicKey serializes the public half of an identity key into PKIX PEM.
+func MarshalPublicKey(pub crypto.PublicKey) ([]byte, error) {
+	if KeyType(pub) == "" {
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// UnmarshalPublicKey reads a public identity key from PKIX PEM, whatever its
+// type.
+func UnmarshalPublicKey(pemData []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("failed to decode PEM block containing public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if KeyType(pub) == "" {
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+	return pub, nil
+}
+
+func PrivateFromPemFile(file string) (crypto.Signer, error) {
+	b, e := os.ReadFile(file)
+	if e != nil {
+		return nil, e
+	}
+	return UnmarshalPrivateKey(b)
+}
+
+func PublicKeyFromPemFile(file string) (crypto.PublicKey, error) {
+	b, e := os.ReadFile(file)
+	if e != nil {
+		return nil, e
+	}
+	return UnmarshalPublicKey(b)
+}
@@ -1,10 +1,11 @@
 package sdtl
 
 import (
-	"crypto/ecdsa"
-	"encoding/binary"
+	"crypto"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
 	"sync"
 	"time"
 )
@@ -16,18 +17,45 @@ const (
 )
 
 type connection struct {
-	publicKey *ecdsa.PublicKey
+	publicKey crypto.PublicKey // or the PSK key the host authenticates with
+	signer    crypto.Signer    // PSK key we authenticate with, nil to sign
+	psk       []byte
+	suites    uint32 // cipher suites the host may use
 	encrypt   *aesCipher
 	mtime     time.Time
 	state     int
+	caps      uint32
 	session   [8]byte
+	udp       *net.UDPConn
 	pubAddr   *net.UDPAddr
 	priAddr   net.IP
+	// STR and SHS as sent, kept until CHS completes the key schedule
+	transcript []byte
+	// CHS as received and the HSD that answered it, to answer it again
+	chs     []byte
+	hsd     []byte
+	rekey   rekeyState
+	dropped uint64
+	// Sessions of the STR already accepted, until their timestamp goes stale.
+	// It outlives close, or a recorded STR could reopen the session.
+	seen map[[8]byte]time.Time
+	// Hosts known by their certificate rather than the configuration
+	certified   bool
+	tags        []string
+	certExpires time.Time
+	certSerial  uint64
+	// Pieces of the packets the host is sending, and the id of our next one
+	frags  reassembly
+	fragID uint32
+	pmtu   pmtuState
+	// Channels of the ready session, see channel.go
+	channels *channelSet
 }
 
 type connTable struct {
-	private map[uint32]*connection
-	public  map[string]*connection
+	private  map[[16]byte]*connection
+	public   map[netip.AddrPort]*connection
+	sessions map[[8]byte]*connection // ready connections only
 }
 
 var instance *connTable
@@ -37,61 +65,180 @@ var once sync.Once
 func getConnTable() *connTable {
 	once.Do(func() {
 		instance = &connTable{
-			private: make(map[uint32]*connection),
-			public:  make(map[string]*connection),
+			private:  make(map[[16]byte]*connection),
+			public:   make(map[netip.AddrPort]*connection),
+			sessions: make(map[[8]byte]*connection),
 		}
 	})
 	return instance
 }
 
-func ipToUint32(ip net.IP) (uint32, error) {
-	ip = ip.To4()
-	if ip == nil {
-		return 0, fmt.Errorf("invalid address")
+// ipKey indexes both families in the same table, IPv4 addresses in their
+// IPv4-mapped form.
+func ipKey(ip net.IP) ([16]byte, error) {
+	var key [16]byte
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return key, fmt.Errorf("invalid address")
 	}
-	return binary.BigEndian.Uint32(ip), nil
+	copy(key[:], ip16)
+	return key, nil
 }
 
-func (c *connTable) addPrivate(ip net.IP, pubKey *ecdsa.PublicKey) error {
-	u32, e := ipToUint32(ip)
+// hostAuth is how a host proves who it is: a public key, a PSK, or both.
+// The PSK alone authenticates the handshake; next to a key it only goes
+// into the key derivation.
+type hostAuth struct {
+	publicKey crypto.PublicKey
+	psk       []byte
+}
+
+func (c *connTable) addPrivate(ip net.IP, auth hostAuth, suites uint32) error {
+	key, e := ipKey(ip)
 	if e != nil {
 		return e
 	}
 
-	client, ok := c.private[u32]
+	client, ok := c.private[key]
 	if ok {
 		return fmt.Errorf("duplicated entry")
 	}
 
 	client = &connection{}
 	client.state = ConnectionClose
-	client.publicKey = pubKey
+	client.publicKey = auth.publicKey
+	client.psk = auth.psk
+	if auth.publicKey == nil {
+		own, peer := pskKeys(auth.psk, false)
+		client.signer = own
+		client.publicKey = peer
+	}
+	client.suites = suites
 	client.priAddr = ip
-	c.private[u32] = client
+	c.private[key] = client
 	return nil
 }
 
+// addCertified registers the host a verified certificate is for, or takes
+// the key of a newer certificate for it. Configured hosts keep their entry.
+func (c *connTable) addCertified(cert *Certificate) (*connection, error) {
+	key, e := ipKey(cert.IP)
+	if e != nil {
+		return nil, e
+	}
+	client, ok := c.private[key]
+	if ok && !client.certified {
+		return nil, fmt.Errorf("address configured for another host")
+	}
+	if !ok {
+		client = &connection{}
+		client.state = ConnectionClose
+		client.priAddr = cert.IP
+		client.suites = capSuites & supportedCaps
+		client.certified = true
+		c.private[key] = client
+	}
+	client.publicKey = cert.PublicKey
+	client.tags = cert.Tags
+	client.certExpires = cert.NotAfter
+	client.certSerial = cert.Serial
+	return client, nil
+}
+
+// addrKey unmaps IPv4 peers seen through a dual-stack socket, so they are
+// the same key as when seen through an IPv4 one.
+func addrKey(addr *net.UDPAddr) netip.AddrPort {
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
 func (c *connTable) addPublic(addr *net.UDPAddr, conn *connection) {
-	c.public[addr.String()] = conn
+	c.public[addrKey(addr)] = conn
+}
+
+// dropPublic removes every public address that leads to conn.
+func (c *connTable) dropPublic(conn *connection) {
+	for key, client := range c.public {
+		if client == conn {
+			delete(c.public, key)
+		}
+	}
+}
+
+func (c *connTable) addSession(conn *connection) {
+	c.sessions[conn.session] = conn
+}
+
+func (c *connTable) dropSession(conn *connection) {
+	if c.sessions[conn.session] == conn {
+		delete(c.sessions, conn.session)
+	}
+}
+
+// migrate moves conn to the address an authenticated frame came from. It
+// reports whether the address changed.
+func (c *connTable) migrate(conn *connection, udp *net.UDPConn, addr *net.UDPAddr) bool {
+	if conn.pubAddr != nil && addrKey(conn.pubAddr) == addrKey(addr) {
+		return false
+	}
+	c.dropPublic(conn)
+	conn.udp = udp
+	conn.pubAddr = addr
+	c.addPublic(addr, conn)
+	return true
+}
+
+// replayedSTR reports whether a STR for session was already accepted, and
+// otherwise remembers it until expires.
+func (conn *connection) replayedSTR(session [8]byte, expires time.Time) bool {
+	now := time.Now()
+	for s, t := range conn.seen {
+		if now.After(t) {
+			delete(conn.seen, s)
+		}
+	}
+	if _, ok := conn.seen[session]; ok {
+		return true
+	}
+	if conn.seen == nil {
+		conn.seen = make(map[[8]byte]time.Time)
+	}
+	conn.seen[session] = expires
+	return false
 }
 
 func (c *connTable) close(conn *connection) {
 	if conn == nil {
 		return
 	}
+	c.dropSession(conn)
 	conn.encrypt = nil
+	conn.transcript = nil
+	conn.chs = nil
+	conn.hsd = nil
+	conn.rekey = rekeyState{}
+	conn.frags = reassembly{}
+	conn.pmtu = pmtuState{}
+	conn.channels.close(io.EOF)
+	conn.channels = nil
 	conn.mtime = time.Time{}
 	conn.state = ConnectionClose
-	if conn.pubAddr != nil {
-		addr := conn.pubAddr.String()
-		delete(c.public, addr)
-		conn.pubAddr = nil
-	}
+	c.dropPublic(conn)
+	conn.pubAddr = nil
+	conn.udp = nil
 	return
 }
 
 func (c *connTable) getConnectionByPublic(addr *net.UDPAddr) (*connection, error) {
-	client, ok := c.public[addr.String()]
+	client, ok := c.public[addrKey(addr)]
+	if ok {
+		return client, nil
+	}
+	return nil, fmt.Errorf("not found")
+}
+
+func (c *connTable) getConnectionBySession(session [8]byte) (*connection, error) {
+	client, ok := c.sessions[session]
 	if ok {
 		return client, nil
 	}
@@ -99,11 +246,11 @@ func (c *connTable) getConnectionByPublic(addr *net.UDPAddr) (*connection, error
 }
 
 func (c *connTable) getConnectionByPrivate(ip net.IP) (*connection, error) {
-	u32, e := ipToUint32(ip)
+	key, e := ipKey(ip)
 	if e != nil {
 		return nil, e
 	}
-	client, ok := c.private[u32]
+	client, ok := c.private[key]
 	if ok {
 		return client, nil
 	}
@@ -0,0 +1,330 @@
+package sdtl
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Path MTU discovery in the manner of PLPMTUD (RFC 8899): each side sends
+// PRB frames padded to the datagram size under test and the other answers
+// with a PRA naming the probe. A size is confirmed by its acknowledgement
+// and given up after pmtuMaxProbes losses, so a binary search between
+// baseDatagram and the configured maximum settles on the largest datagram
+// the path carries. The confirmed size is probed again from time to time;
+// if it stops getting through, the search starts over from the base.
+const (
+	pmtuProbeHeaderSize = 4     // probe id
+	pmtuAckSize         = 4 + 2 // probe id, probe size
+	pmtuProbeTimeout    = time.Second
+	pmtuMaxProbes       = 3
+	pmtuRecheck         = 10 * time.Minute
+)
+
+type pmtuState struct {
+	size      int // largest datagram known to get through
+	low, high int // bounds of the search
+	base, max int
+	probe     int // size of the probe in flight, 0 when none
+	id        uint32
+	sent      time.Time
+	tries     int
+	settled   time.Time // when the search last ended
+}
+
+// reset starts a search between base and max, with base in use meanwhile.
+func (p *pmtuState) reset(base, max int) {
+	*p = pmtuState{
+		size: base,
+		low:  base,
+		high: max,
+		base: base,
+		max:  max,
+	}
+	if base >= max {
+		p.settled = time.Now()
+	}
+}
+
+// next returns the size and id of the probe to send now, or 0 when none is
+// due. A probe unanswered after pmtuProbeTimeout counts as lost.
+func (p *pmtuState) next(now time.Time) (int, uint32) {
+	if p.size == 0 {
+		return 0, 0
+	}
+	if p.probe != 0 {
+		if now.Sub(p.sent) < pmtuProbeTimeout {
+			return 0, 0
+		}
+		p.tries++
+		if p.tries >= pmtuMaxProbes {
+			p.lost(now)
+		}
+	}
+	if p.probe == 0 {
+		switch {
+		case p.low < p.high:
+			p.probe = (p.low + p.high + 1) / 2
+		case now.Sub(p.settled) >= pmtuRecheck:
+			p.probe = p.size
+		default:
+			return 0, 0
+		}
+		p.tries = 0
+	}
+	p.id++
+	p.sent = now
+	return p.probe, p.id
+}
+
+// lost gives up the size being probed.
+func (p *pmtuState) lost(now time.Time) {
+	if p.probe > p.size {
+		p.high = p.probe - 1
+	} else {
+		// What used to get through no longer does
+		p.size = p.base
+		p.low = p.base
+	}
+	p.probe = 0
+	if p.low >= p.high {
+		p.settled = now
+	}
+}
+
+// acked takes the acknowledgement of probe id and reports whether the
+// datagram size in use changed.
+func (p *pmtuState) acked(id uint32, size int, now time.Time) bool {
+	if p.probe == 0 || id != p.id || size != p.probe {
+		return false
+	}
+	p.probe = 0
+	changed := size > p.size
+	if changed {
+		p.size = size
+		p.low = size
+	} else {
+		// Confirmed again, look for more room
+		p.high = p.max
+	}
+	if p.low >= p.high {
+		p.settled = now
+	}
+	return changed
+}
+
+// startDiscovery resets p for a new session. Without discovery the
+// configured maximum is used as is.
+func (p *pmtuState) startDiscovery(caps uint32, max int) {
+	if caps&capPMTU == 0 {
+		p.reset(max, max)
+		return
+	}
+	p.reset(min(baseDatagram, max), max)
+}
+
+// packetSize is the largest tunneled packet that fits in one datagram of
+// size bytes.
+func packetSize(c *aesCipher, size int) int {
+	return size - c.suite.headerSize()
+}
+
+// probeFrame seals a PRB padded to size bytes on the wire.
+func probeFrame(c *aesCipher, size int, id uint32) ([]byte, error) {
+	n := packetSize(c, size)
+	if n < pmtuProbeHeaderSize {
+		return nil, fmt.Errorf("probe too small: %d", size)
+	}
+	return packDataFrame(c, msgPRB, encodeProbe(id, n))
+}
+
+// probeAck seals the PRA answering a probe that arrived with size bytes.
+func probeAck(c *aesCipher, probe []byte, size int) ([]byte, error) {
+	id, e := decodeProbe(probe)
+	if e != nil {
+		return nil, e
+	}
+	return packDataFrame(c, msgPRA, encodeProbeAck(id, size))
+}
+
+// PathMTU returns the largest datagram the path to the server is known to
+// carry, 0 before Connect.
+func (s *Socket) PathMTU() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pmtu.size
+}
+
+// SetMTUHandler sets a function called with the largest tunneled packet
+// that fits in one datagram, once the session is up and whenever path MTU
+// discovery changes it, for instance to set the MTU of the TUN interface.
+// It must not call back into the socket.
+func (s *Socket) SetMTUHandler(f func(mtu int)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onMTU = f
+}
+
+// notifyMTU calls the MTU handler, if any; the caller holds s.mu.
+func (s *Socket) notifyMTU() {
+	if s.onMTU != nil && s.encrypt != nil {
+		s.onMTU(packetSize(s.encrypt, s.pmtu.size))
+	}
+}
+
+// startProbing runs path MTU discovery for the session just established.
+func (s *Socket) startProbing() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.encrypt == nil {
+		return
+	}
+	s.notifyMTU()
+	if s.caps&capPMTU == 0 {
+		return
+	}
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+	}
+	go s.probeLoop(s.stop)
+}
+
+func (s *Socket) probeLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(pmtuProbeTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		encrypt := s.encrypt
+		conn, raddr := s.conn, s.raddr
+		before := s.pmtu.size
+		size, id := s.pmtu.next(time.Now())
+		if s.pmtu.size != before {
+			s.notifyMTU()
+		}
+		s.mu.Unlock()
+		if encrypt == nil {
+			return
+		}
+		if size == 0 {
+			continue
+		}
+		data, err := probeFrame(encrypt, size, id)
+		if err != nil {
+			continue
+		}
+		conn.WriteToUDP(data, raddr)
+	}
+}
+
+// handleProbe answers a PRB or takes a PRA; the caller holds s.mu.
+func (s *Socket) handleProbe(msgType byte, payload []byte, size int) error {
+	if msgType == msgPRB {
+		ack, err := probeAck(s.encrypt, payload, size)
+		if err != nil {
+			return err
+		}
+		_, err = s.conn.WriteToUDP(ack, s.raddr)
+		return err
+	}
+	id, probed, err := decodeProbeAck(payload)
+	if err != nil {
+		return err
+	}
+	if s.pmtu.acked(id, probed, time.Now()) {
+		s.notifyMTU()
+	}
+	return nil
+}
+
+// PathMTU returns the largest datagram the path to the host at the overlay
+// address ip is known to carry.
+func (s *Server) PathMTU(ip string) (int, error) {
+	var size int
+	host := net.ParseIP(ip)
+	if host == nil {
+		return 0, fmt.Errorf("invalid overlay address: %s", ip)
+	}
+	err := s.do(func(send chan<- *IOMessage) {
+		conn, e := getConnTable().getConnectionByPrivate(host)
+		if e == nil && conn.state == ConnectionReady {
+			size = conn.pmtu.size
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if size == 0 {
+		return 0, fmt.Errorf("no session with %s", ip)
+	}
+	return size, nil
+}
+
+// probeSessions sends the probes due on every ready session.
+func (s *Server) probeSessions(send chan<- *IOMessage) {
+	ct := getConnTable()
+	now := time.Now()
+	for _, conn := range ct.private {
+		if conn.state != ConnectionReady || conn.encrypt == nil || conn.pubAddr == nil {
+			continue
+		}
+		if conn.caps&capPMTU == 0 {
+			continue
+		}
+		before := conn.pmtu.size
+		size, id := conn.pmtu.next(now)
+		if conn.pmtu.size != before {
+			log("INFO: Path MTU to %s: %d", conn.priAddr.String(), conn.pmtu.size)
+		}
+		if size == 0 {
+			continue
+		}
+		data, e := probeFrame(conn.encrypt, size, id)
+		if e != nil {
+			log("ERROR: probe %s: %v", conn.priAddr.String(), e)
+			continue
+		}
+		msg := &IOMessage{
+			udp:  conn.udp,
+			addr: conn.pubAddr,
+			n:    len(data),
+		}
+		copy(msg.buffer[:], data)
+		send <- msg
+	}
+}
+
+// handleProbe answers a PRB with a PRA, or takes the PRA for one of ours.
+func handleProbe(msg *IOMessage) (*IOMessage, error) {
+	size := msg.n
+	conn, f, b, e := openFrame("handleProbe", msg)
+	if e != nil {
+		return nil, e
+	}
+	if conn.caps&capPMTU == 0 {
+		return nil, errorf("handleProbe", "path MTU discovery not negotiated", nil)
+	}
+	if f.msgType == msgPRA {
+		id, probed, e := decodeProbeAck(b)
+		if e != nil {
+			return nil, errorf("handleProbe", "invalid ack", e)
+		}
+		if conn.pmtu.acked(id, probed, time.Now()) {
+			log("INFO: Path MTU to %s: %d", conn.priAddr.String(), conn.pmtu.size)
+		}
+		return nil, nil
+	}
+	data, e := probeAck(conn.encrypt, b, size)
+	if e != nil {
+		return nil, errorf("handleProbe", "answering probe", e)
+	}
+	copy(msg.buffer[:], data)
+	msg.n = len(data)
+	msg.udp = conn.udp
+	msg.addr = conn.pubAddr
+	return msg, nil
+}
@@ -0,0 +1,87 @@
+package sdtl
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+const (
+	pskMinSize = 16
+
+	pskLabelClient = "sdtl psk client"
+	pskLabelServer = "sdtl psk server"
+)
+
+// pskMAC authenticates handshake messages with HMAC-SHA256 for hosts that
+// share a secret with the server instead of a key pair. Each direction has
+// its own key, derived from the PSK, so a message cannot be reflected back
+// to its sender. It stands in for both the private and the public key.
+type pskMAC []byte
+
+// pskKeys returns the key our messages are authenticated with and the one
+// the peer's are.
+func pskKeys(psk []byte, client bool) (pskMAC, pskMAC) {
+	c := pskMAC(psk).mac([]byte(pskLabelClient))
+	s := pskMAC(psk).mac([]byte(pskLabelServer))
+	if client {
+		return c, s
+	}
+	return s, c
+}
+
+func (k pskMAC) mac(message []byte) []byte {
+	h := hmac.New(sha256.New, k)
+	h.Write(message)
+	return h.Sum(nil)
+}
+
+func (k pskMAC) Public() crypto.PublicKey {
+	return k
+}
+
+func (k pskMAC) Sign(_ io.Reader, message []byte, _ crypto.SignerOpts) ([]byte, error) {
+	return k.mac(message), nil
+}
+
+// ParsePresharedKey decodes a hex PSK, as written in the configuration.
+func ParsePresharedKey(s string) ([]byte, error) {
+	psk, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PSK: %w", err)
+	}
+	if len(psk) < pskMinSize {
+		return nil, fmt.Errorf("PSK too short, at least %d bytes", pskMinSize)
+	}
+	return psk, nil
+}
+
+// NewSocketClientPSK returns a socket that authenticates the handshake with
+// psk alone; Connect then takes a nil server key.
+func NewSocketClientPSK(psk []byte) (*Socket, error) {
+	if len(psk) < pskMinSize {
+		return nil, fmt.Errorf("PSK too short, at least %d bytes", pskMinSize)
+	}
+	own, peer := pskKeys(psk, true)
+	s, err := newSocket(own)
+	if err != nil {
+		return nil, err
+	}
+	s.verifykey = peer
+	s.psk = psk
+	return s, nil
+}
+
+// SetPresharedKey mixes psk into the key derivation of the next Connect on
+// top of the signatures, as the server does for hosts configured with both
+// a public key and a PSK.
+func (s *Socket) SetPresharedKey(psk []byte) error {
+	if len(psk) < pskMinSize {
+		return fmt.Errorf("PSK too short, at least %d bytes", pskMinSize)
+	}
+	s.psk = psk
+	return nil
+}
@@ -0,0 +1,107 @@
+package sdtl
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPSKSignatures(t *testing.T) {
+	psk := bytes.Repeat([]byte{7}, pskMinSize)
+	clientOwn, clientPeer := pskKeys(psk, true)
+	serverOwn, serverPeer := pskKeys(psk, false)
+	if !bytes.Equal(clientOwn, serverPeer) || !bytes.Equal(clientPeer, serverOwn) {
+		t.Fatal("both ends must agree on the keys")
+	}
+	msg := []byte("STR")
+	sig, err := signMessage(clientOwn, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifySignature(serverPeer, msg, sig) {
+		t.Fatal("the server must accept the client's MAC")
+	}
+	if verifySignature(clientPeer, msg, sig) {
+		t.Fatal("a MAC must not verify in the other direction")
+	}
+	if verifySignature(serverPeer, []byte("SHS"), sig) {
+		t.Fatal("a MAC must not verify for another message")
+	}
+	other, _ := pskKeys(bytes.Repeat([]byte{8}, pskMinSize), false)
+	if verifySignature(other, msg, sig) {
+		t.Fatal("a MAC must not verify with another PSK")
+	}
+}
+
+// The PSK is mixed into the keys, so both ends agree only when they share
+// it, whatever the ECDH exchange.
+func TestPSKMixing(t *testing.T) {
+	keys := func(clientPSK, serverPSK []byte) (*aesCipher, *aesCipher) {
+		client, err := newCipher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := newCipher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.psk, server.psk = clientPSK, serverPSK
+		session := createRandomSession()
+		transcript := transcriptHash(client.PublicKey(), server.PublicKey())
+		for _, c := range []struct {
+			own, peer *aesCipher
+			client    bool
+		}{{client, server, true}, {server, client, false}} {
+			if err := c.own.SharedSecret(c.peer.PublicKey()); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.own.DeriveKeys(session[:], transcript, c.client); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return client, server
+	}
+	psk := bytes.Repeat([]byte{7}, pskMinSize)
+	c, s := keys(psk, psk)
+	if !bytes.Equal(c.txKey, s.rxKey) || !bytes.Equal(c.rxKey, s.txKey) {
+		t.Fatal("both ends must agree on the keys")
+	}
+	if c.psk != nil || s.psk != nil {
+		t.Fatal("the PSK must not stay in the session")
+	}
+	th := transcriptHash([]byte("CHS"))
+	if !bytes.Equal(confirmKeys(c.confirm, th), confirmKeys(s.confirm, th)) {
+		t.Fatal("both ends must agree on the HSD MAC")
+	}
+	c, s = keys(psk, bytes.Repeat([]byte{8}, pskMinSize))
+	if bytes.Equal(c.txKey, s.rxKey) {
+		t.Fatal("different PSKs must give different keys")
+	}
+	if bytes.Equal(confirmKeys(c.confirm, th), confirmKeys(s.confirm, th)) {
+		t.Fatal("different PSKs must fail the HSD MAC")
+	}
+	c, s = keys(psk, nil)
+	if bytes.Equal(c.txKey, s.rxKey) {
+		t.Fatal("a PSK on one end only must give different keys")
+	}
+}
+
+func TestParsePresharedKey(t *testing.T) {
+	tests := []struct {
+		in string
+		ok bool
+	}{
+		{"000102030405060708090a0b0c0d0e0f", true},
+		{"000102030405060708090a0b0c0d0e", false},
+		{"000102030405060708090a0b0c0d0e0g", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		psk, err := ParsePresharedKey(tt.in)
+		if (err == nil) != tt.ok {
+			t.Fatalf("ParsePresharedKey(%q): %v", tt.in, err)
+		}
+		if tt.ok && len(psk) != len(tt.in)/2 {
+			t.Fatalf("ParsePresharedKey(%q) = %x", tt.in, psk)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package sdtl
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Why the server refused a STR, carried in a REJ. The REJ is signed like
+// the SHS it stands for and names the session of the STR, so the client
+// can give up at once instead of retrying until it times out. It comes in
+// the version of the STR if the server speaks it, and the client takes it
+// in any, or a server that speaks none of its versions could not say so.
+// Only a STR that passed the cookie check and whose signature verified
+// gets one; any other is dropped, so forged STRs cost the server no
+// signature. The exception is a host the server does not know, see
+// rejectUnknown.
+const (
+	rejectRefused      = 0
+	rejectUnknownHost  = 1
+	rejectUnauthorized = 2
+	rejectVersion      = 3
+
+	// REJ to unknown hosts the server signs in a second
+	DefaultUnknownHostRate = 20
+)
+
+var (
+	// ErrUnknownHost is returned by Connect when the server has no host
+	// with our overlay address and no certificate made us one. A PSK
+	// client cannot verify this REJ, and times out instead.
+	ErrUnknownHost = errors.New("unknown host")
+	// ErrUnauthorized is returned by Connect when the server does not take
+	// our key or certificate, or it has been revoked.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrVersion is returned by Connect when the server shares no protocol
+	// version or cipher suite with us.
+	ErrVersion = errors.New("no common version or cipher suite")
+	// ErrRejected is returned by Connect when the server refused the
+	// handshake for any other reason, such as our clock being off.
+	ErrRejected = errors.New("handshake rejected")
+)
+
+func rejectError(reason byte) error {
+	switch reason {
+	case rejectUnknownHost:
+		return ErrUnknownHost
+	case rejectUnauthorized:
+		return ErrUnauthorized
+	case rejectVersion:
+		return ErrVersion
+	}
+	return ErrRejected
+}
+
+// isRejected reports whether err comes from a REJ, which ends the handshake
+// with every address of the server.
+func isRejected(err error) bool {
+	return errors.Is(err, ErrUnknownHost) || errors.Is(err, ErrUnauthorized) ||
+		errors.Is(err, ErrVersion) || errors.Is(err, ErrRejected)
+}
+
+// rejectSTR turns the STR in msg into the REJ answering it, or returns nil
+// when there is no key to sign it with.
+func rejectSTR(signkey crypto.Signer, session [8]byte, reason byte, msg *IOMessage) *IOMessage {
+	if signkey == nil {
+		return nil
+	}
+	rej := handShakeReject{session: session, reason: reason}
+	data, e := packHandShakeMessage(signkey, replyVersion(msg), msgREJ, &rej)
+	if e != nil {
+		log("ERROR: packing reject: %v", e)
+		return nil
+	}
+	copy(msg.buffer[:], data)
+	msg.n = len(data)
+	return msg
+}
+
+// rejectUnknown answers the STR in msg if its host is not configured and
+// it brings no certificate, and reports whether it was such a STR. Its
+// signature cannot be checked, so the REJ, signed with the server key, only
+// goes to a STR that echoes a cookie for its address and session, as given
+// out in an HVR, and within the rate of unknownHosts; before that the STR
+// gets the HVR.
+func (s *Server) rejectUnknown(msg *IOMessage) (*IOMessage, bool) {
+	var start startHandShake
+	body := msg.buffer[msgHeaderSize:msg.n]
+	if _, e := start.decode(body, 0); e != nil || start.cert != nil {
+		return nil, false
+	}
+	if _, e := getConnTable().getConnectionByPrivate(extractIP(start.ip[:])); e == nil {
+		return nil, false
+	}
+	if s.priKey == nil {
+		return nil, true
+	}
+	session := start.session[:]
+	if len(body) > cookieSize && s.cookies.verify(msg.addr, session, body[len(body)-cookieSize:]) {
+		if !s.unknownHosts.allow(time.Now()) {
+			return nil, true
+		}
+		return rejectSTR(s.priKey, start.session, rejectUnknownHost, msg), true
+	}
+	if start.caps&capCookie == 0 {
+		return nil, true
+	}
+	return s.cookies.helloVerify(msg, start.session), true
+}
+
+func (hs *handShakeReject) error() error {
+	return fmt.Errorf("server refused the handshake: %w", rejectError(hs.reason))
+}
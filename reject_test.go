@@ -0,0 +1,106 @@
+package sdtl
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// A host the server does not know gets an HVR, and a REJ once it echoes
+// the cookie, both in the version of its STR.
+func TestRejectUnknownHost(t *testing.T) {
+	signer, err := GenerateSigner(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies, err := newCookieJar(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyConnTable(t)
+	s := &Server{
+		priKey:       signer,
+		cookies:      cookies,
+		unknownHosts: rateLimit{limit: 1},
+	}
+	str := testSTR(t, capCookie|capSuiteAESGCM)
+	str[0] = protocolVerPrev
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 7000}
+	send := make(chan *IOMessage, 1)
+
+	msg := &IOMessage{addr: addr, n: len(str)}
+	copy(msg.buffer[:], str)
+	res, _ := s.handleMessage(msg, send)
+	if res == nil || res.buffer[0] != protocolVerPrev || res.buffer[1] != msgHVR {
+		t.Fatalf("want an HVR in %x, got %v", protocolVerPrev, res)
+	}
+	var hv helloVerify
+	if err := hv.decode(res.buffer[msgHeaderSize:res.n]); err != nil {
+		t.Fatal(err)
+	}
+
+	withCookie := append(str, hv.cookie[:]...)
+	for i := 0; i < 2; i++ {
+		msg = &IOMessage{addr: addr, n: len(withCookie)}
+		copy(msg.buffer[:], withCookie)
+		res, _ = s.handleMessage(msg, send)
+		if i == 1 {
+			if res != nil {
+				t.Fatal("REJ over the rate")
+			}
+			break
+		}
+		if res == nil || res.buffer[0] != protocolVerPrev || res.buffer[1] != msgREJ {
+			t.Fatalf("want a REJ in %x, got %v", protocolVerPrev, res)
+		}
+		var rej handShakeReject
+		if err := rej.load(signer.Public(), res.buffer[msgHeaderSize:res.n]); err != nil {
+			t.Fatal(err)
+		}
+		if !errors.Is(rej.error(), ErrUnknownHost) {
+			t.Fatalf("reason %d", rej.reason)
+		}
+	}
+}
+
+// A server that speaks none of our versions still gets its REJ through.
+func TestConnectRejectedOtherVersion(t *testing.T) {
+	serverKey, err := GenerateSigner(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := GenerateSigner(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		data, addr, err := readFromUDP(conn)
+		if err != nil {
+			return
+		}
+		var start startHandShake
+		if _, err := start.decode(data[msgHeaderSize:], 0); err != nil {
+			return
+		}
+		rej := handShakeReject{session: start.session, reason: rejectVersion}
+		reply, err := packHandShakeMessage(serverKey, ProtocolVer+1, msgREJ, &rej)
+		if err != nil {
+			return
+		}
+		conn.WriteToUDP(reply, addr)
+	}()
+
+	client, err := NewSocketClient(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Connect(conn.LocalAddr().String(), serverKey.Public(), "10.9.0.2")
+	if !errors.Is(err, ErrVersion) {
+		t.Fatalf("Connect = %v, want %v", err, ErrVersion)
+	}
+}
@@ -0,0 +1,169 @@
+package sdtl
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultRekeyAfter = 10 * time.Minute
+	DefaultRekeyBytes = 1 << 32
+
+	// Long before the counter runs out, whatever the thresholds say
+	rekeyCounterLimit = 1 << 48
+	// How long an unanswered RKQ waits before it is sent again
+	rekeyRetry = 2 * time.Second
+	// How long the replaced key still decrypts frames already in flight,
+	// once the peer is known to use the new one
+	rekeyOverlap = 10 * time.Second
+
+	sizeRKX = 65
+)
+
+// rekeyState tracks the key replaced by the last rekey and the exchange in
+// progress, if any. Either side may request a rekey with an RKQ carrying a
+// fresh ECDH public key, sealed with the current session key; the peer
+// answers with its own in an RKS. The requester switches to the new key on
+// the RKS, but the peer goes on sending with the old one until a frame
+// sealed with the new key shows the RKS arrived, so nothing it sends in
+// between is lost. Until then the requester keeps the old key too.
+type rekeyState struct {
+	previous *aesCipher
+	expires  time.Time  // zero while the peer may still send with previous
+	next     *aesCipher // answered, waiting for the peer to use it
+	pending  *aesCipher
+	sent     time.Time
+	answered [sizeRKX]byte
+	reply    []byte
+}
+
+func rekeyDue(c *aesCipher, after time.Duration, volume uint64) bool {
+	return time.Since(c.created) >= after ||
+		c.bytes.Load() >= volume ||
+		c.txCounter.Load() >= rekeyCounterLimit
+}
+
+// rekeyTranscript orders both public keys client first, so the two sides
+// agree on the context no matter who started the exchange.
+func rekeyTranscript(own []byte, remote []byte, client bool) []byte {
+	if client {
+		return transcriptHash(own, remote)
+	}
+	return transcriptHash(remote, own)
+}
+
+func deriveRekey(next *aesCipher, current *aesCipher, remote []byte, client bool) error {
+	next.version = current.version
+	next.session = current.session
+	next.suite = current.suite
+	e := next.SharedSecret(remote)
+	if e != nil {
+		return e
+	}
+	transcript := rekeyTranscript(next.PublicKey(), remote, client)
+	return next.DeriveKeys(current.chain, transcript, client)
+}
+
+// open decrypts a frame with the current key, with the answered one, which
+// then becomes current, and with the key it replaced while the overlap
+// lasts. It returns the key to use from now on.
+func (r *rekeyState) open(current *aesCipher, f *sealedFrame) (*aesCipher, []byte, error) {
+	now := time.Now()
+	b, e := openSealed(current, f)
+	if e == nil {
+		if r.previous != nil && r.expires.IsZero() {
+			// The peer uses the new key, what it sent before is in flight
+			r.expires = now.Add(rekeyOverlap)
+		}
+		return current, b, nil
+	}
+	if r.next != nil {
+		if nb, ne := openSealed(r.next, f); ne == nil {
+			r.previous = current
+			r.expires = now.Add(rekeyOverlap)
+			current, r.next = r.next, nil
+			return current, nb, nil
+		}
+	}
+	if r.previous == nil {
+		return current, b, e
+	}
+	if !r.expires.IsZero() && now.After(r.expires) {
+		r.previous = nil
+		return current, b, e
+	}
+	pb, pe := openSealed(r.previous, f)
+	if pe != nil {
+		return current, b, e
+	}
+	return current, pb, nil
+}
+
+// request returns the RKQ to send when the current key is due for a rekey,
+// or again when the pending one went unanswered. It returns nil when there
+// is nothing to send.
+func (r *rekeyState) request(current *aesCipher, after time.Duration, volume uint64) ([]byte, error) {
+	if r.pending == nil {
+		if !rekeyDue(current, after, volume) {
+			return nil, nil
+		}
+		next, e := newCipher()
+		if e != nil {
+			return nil, e
+		}
+		r.pending = next
+	} else if time.Since(r.sent) < rekeyRetry {
+		return nil, nil
+	}
+	r.sent = time.Now()
+	return packDataFrame(current, msgRKQ, r.pending.PublicKey())
+}
+
+// answer handles the peer's RKQ and returns the RKS to send back. The new
+// key waits in r.next for open to see the peer use it. When both sides
+// start a rekey at once the server gives up its own and the client ignores
+// the server's, so the reply is nil.
+func (r *rekeyState) answer(current *aesCipher, epk [sizeRKX]byte, client bool) ([]byte, error) {
+	if r.reply != nil && r.answered == epk {
+		// Our RKS got lost, the peer is still waiting for it
+		return r.reply, nil
+	}
+	if r.pending != nil {
+		if client {
+			return nil, nil
+		}
+		r.pending = nil
+	}
+	next, e := newCipher()
+	if e != nil {
+		return nil, e
+	}
+	e = deriveRekey(next, current, epk[:], client)
+	if e != nil {
+		return nil, e
+	}
+	reply, e := packDataFrame(current, msgRKS, next.PublicKey())
+	if e != nil {
+		return nil, e
+	}
+	r.answered = epk
+	r.reply = reply
+	r.next = next
+	return reply, nil
+}
+
+// complete finishes the rekey this side requested and returns the new key.
+func (r *rekeyState) complete(current *aesCipher, epk [sizeRKX]byte, client bool) (*aesCipher, error) {
+	if r.pending == nil {
+		return current, fmt.Errorf("unexpected rekey response")
+	}
+	next := r.pending
+	e := deriveRekey(next, current, epk[:], client)
+	if e != nil {
+		return current, e
+	}
+	r.pending = nil
+	r.previous = current
+	r.expires = time.Time{}
+	return next, nil
+}
@@ -0,0 +1,228 @@
+package sdtl
+
+import (
+	"bytes"
+	"testing"
+)
+
+// rekeyEnd is one side of a session: its key and its rekey state.
+type rekeyEnd struct {
+	t      *testing.T
+	key    *aesCipher
+	rekey  rekeyState
+	client bool
+}
+
+func (e *rekeyEnd) seal(msgType byte, payload []byte) []byte {
+	data, err := packDataFrame(e.key, msgType, payload)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return data
+}
+
+func (e *rekeyEnd) open(frame []byte) []byte {
+	f, err := parseFrame(frame, e.key.suite.saltSize)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	key, b, err := e.rekey.open(e.key, f)
+	if err != nil {
+		e.t.Fatalf("client %v: opening frame: %v", e.client, err)
+	}
+	e.key = key
+	return b
+}
+
+// openKey opens an RKQ or RKS and returns the key it carries.
+func (e *rekeyEnd) openKey(frame []byte) [sizeRKX]byte {
+	epk, err := decodeRekey(e.open(frame))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return epk
+}
+
+// testSession returns both ends of a fresh session using suite.
+func testSession(t *testing.T, suite *cipherSuite) (*rekeyEnd, *rekeyEnd) {
+	client, err := newCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := createRandomSession()
+	transcript := transcriptHash(client.PublicKey(), server.PublicKey())
+	for _, c := range []struct {
+		own, peer *aesCipher
+		client    bool
+	}{{client, server, true}, {server, client, false}} {
+		c.own.version = ProtocolVer
+		c.own.session = session
+		c.own.suite = suite
+		if err := c.own.SharedSecret(c.peer.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		own    *aesCipher
+		client bool
+	}{{client, true}, {server, false}} {
+		if err := c.own.DeriveKeys(session[:], transcript, c.client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &rekeyEnd{t: t, key: client, client: true}, &rekeyEnd{t: t, key: server}
+}
+
+func TestSessionKeys(t *testing.T) {
+	c, s := testSession(t, cipherSuites[0])
+	if !bytes.Equal(c.key.txKey, s.key.rxKey) || !bytes.Equal(c.key.rxKey, s.key.txKey) {
+		t.Fatal("both ends must agree on the keys")
+	}
+	if bytes.Equal(c.key.txKey, c.key.rxKey) {
+		t.Fatal("each direction needs its own key")
+	}
+	if !bytes.Equal(c.key.chain, s.key.chain) {
+		t.Fatal("both ends must agree on the chain key")
+	}
+}
+
+// TestRekey runs a rekey started by either side, with frames in flight in
+// both directions while the keys switch over.
+func TestRekey(t *testing.T) {
+	for _, suite := range cipherSuites {
+		for _, clientFirst := range []bool{true, false} {
+			c, s := testSession(t, suite)
+			req, resp := s, c
+			if clientFirst {
+				req, resp = c, s
+			}
+			oldReq, oldResp := req.key, resp.key
+
+			rkq, err := req.rekey.request(req.key, 0, DefaultRekeyBytes)
+			if err != nil || rkq == nil {
+				t.Fatalf("requesting rekey: %v", err)
+			}
+			// Sent by the requester before the RKS arrives
+			reqEarly := req.seal(msgDFE, []byte("req before RKS"))
+
+			rks, err := resp.rekey.answer(resp.key, resp.openKey(rkq), resp.client)
+			if err != nil || rks == nil {
+				t.Fatalf("answering rekey: %v", err)
+			}
+			if resp.key != oldResp {
+				t.Fatal("the responder must keep its key until the peer uses the new one")
+			}
+			// Sent by the responder before the RKS arrives
+			respEarly := resp.seal(msgDFE, []byte("resp before RKS"))
+			if got := req.open(respEarly); string(got) != "resp before RKS" {
+				t.Fatalf("frame before the RKS: %q", got)
+			}
+
+			req.key, err = req.rekey.complete(req.key, req.openKey(rks), req.client)
+			if err != nil {
+				t.Fatalf("completing rekey: %v", err)
+			}
+			// Sent by the responder after the RKS, still with the old key
+			respLate := resp.seal(msgDFE, []byte("resp after RKS"))
+
+			reqNew := req.seal(msgDFE, []byte("req new key"))
+			if got := resp.open(reqNew); string(got) != "req new key" {
+				t.Fatalf("frame under the new key: %q", got)
+			}
+			if resp.key == oldResp {
+				t.Fatal("the responder must switch once the peer uses the new key")
+			}
+			if got := resp.open(reqEarly); string(got) != "req before RKS" {
+				t.Fatalf("old frame after the switch: %q", got)
+			}
+			if got := req.open(respLate); string(got) != "resp after RKS" {
+				t.Fatalf("old frame after the RKS: %q", got)
+			}
+			respNew := resp.seal(msgDFE, []byte("resp new key"))
+			if got := req.open(respNew); string(got) != "resp new key" {
+				t.Fatalf("reply under the new key: %q", got)
+			}
+
+			if !bytes.Equal(c.key.txKey, s.key.rxKey) || !bytes.Equal(c.key.rxKey, s.key.txKey) {
+				t.Fatal("both ends must agree on the new keys")
+			}
+			if !bytes.Equal(c.key.chain, s.key.chain) {
+				t.Fatal("both ends must agree on the new chain key")
+			}
+			if bytes.Equal(req.key.txKey, oldReq.txKey) || bytes.Equal(resp.key.txKey, oldResp.txKey) {
+				t.Fatal("the keys must change")
+			}
+		}
+	}
+}
+
+// TestRekeyLostReply answers a repeated RKQ with the same RKS, so both ends
+// still end up on the same key.
+func TestRekeyLostReply(t *testing.T) {
+	c, s := testSession(t, cipherSuites[0])
+	rkq, err := c.rekey.request(c.key, 0, DefaultRekeyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epk := s.openKey(rkq)
+	first, err := s.rekey.answer(s.key, epk, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := s.rekey.answer(s.key, epk, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, again) {
+		t.Fatal("a repeated RKQ must get the same RKS")
+	}
+	c.key, err = c.rekey.complete(c.key, c.openKey(again), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.open(c.seal(msgDFE, []byte("x"))); string(got) != "x" {
+		t.Fatalf("frame under the new key: %q", got)
+	}
+	if !bytes.Equal(c.key.txKey, s.key.rxKey) {
+		t.Fatal("both ends must agree on the new keys")
+	}
+}
+
+// TestRekeyCollision has both sides request at once: the server gives up
+// its own rekey and the client ignores the server's.
+func TestRekeyCollision(t *testing.T) {
+	c, s := testSession(t, cipherSuites[0])
+	crkq, err := c.rekey.request(c.key, 0, DefaultRekeyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srkq, err := s.rekey.request(s.key, 0, DefaultRekeyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := c.rekey.answer(c.key, c.openKey(srkq), true)
+	if err != nil || reply != nil {
+		t.Fatalf("the client must ignore the server's RKQ: %v", err)
+	}
+	rks, err := s.rekey.answer(s.key, s.openKey(crkq), false)
+	if err != nil || rks == nil {
+		t.Fatalf("the server must answer the client's RKQ: %v", err)
+	}
+	if s.rekey.pending != nil {
+		t.Fatal("the server must give up its own rekey")
+	}
+	c.key, err = c.rekey.complete(c.key, c.openKey(rks), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.open(c.seal(msgDFE, []byte("x"))); string(got) != "x" {
+		t.Fatalf("frame under the new key: %q", got)
+	}
+	if !bytes.Equal(c.key.txKey, s.key.rxKey) || !bytes.Equal(c.key.rxKey, s.key.txKey) {
+		t.Fatal("both ends must agree on the new keys")
+	}
+}
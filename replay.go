@@ -0,0 +1,47 @@
+package sdtl
+
+const (
+	replayWindowWords = 32
+	// The block holding the highest counter is only partially usable, so
+	// the guaranteed window is one block short of the bitmap.
+	replayWindowSize = (replayWindowWords - 1) * 64
+)
+
+// replayWindow is the RFC 6479 sliding window: a ring of bitmap blocks
+// indexed by counter, advanced whenever a newer counter is accepted.
+type replayWindow struct {
+	last    uint64
+	started bool
+	bitmap  [replayWindowWords]uint64
+}
+
+// check reports whether counter is new and inside the window. It does not
+// record it; call update once the frame has been authenticated.
+func (w *replayWindow) check(counter uint64) bool {
+	if !w.started || counter > w.last {
+		return true
+	}
+	if w.last-counter >= replayWindowSize {
+		return false
+	}
+	block := (counter >> 6) % replayWindowWords
+	return w.bitmap[block]&(1<<(counter&63)) == 0
+}
+
+func (w *replayWindow) update(counter uint64) {
+	if !w.started || counter > w.last {
+		if w.started {
+			diff := (counter >> 6) - (w.last >> 6)
+			if diff > replayWindowWords {
+				diff = replayWindowWords
+			}
+			for i := uint64(1); i <= diff; i++ {
+				w.bitmap[((w.last>>6)+i)%replayWindowWords] = 0
+			}
+		}
+		w.last = counter
+		w.started = true
+	}
+	block := (counter >> 6) % replayWindowWords
+	w.bitmap[block] |= 1 << (counter & 63)
+}
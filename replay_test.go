@@ -0,0 +1,69 @@
+package sdtl
+
+import "testing"
+
+func TestReplayWindow(t *testing.T) {
+	type step struct {
+		counter uint64
+		ok      bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"in order", []step{{0, true}, {1, true}, {2, true}}},
+		{"duplicate", []step{{0, true}, {1, true}, {1, false}, {0, false}}},
+		{"out of order", []step{{5, true}, {3, true}, {4, true}, {3, false}}},
+		{"exact edge", []step{
+			{replayWindowSize, true},
+			{1, true},
+			{0, false},
+			{1, false},
+		}},
+		{"old counter", []step{{10000, true}, {10000 - replayWindowSize, false}, {5, false}}},
+		{"jump past the window", []step{
+			{1, true},
+			{2, true},
+			{1 + 4*replayWindowSize, true},
+			{2, false},
+			{3 + 3*replayWindowSize, true},
+			{3 + 3*replayWindowSize, false},
+		}},
+		{"jump clears reused blocks", []step{
+			{7, true},
+			{7 + replayWindowWords*64, true},
+			{7 + replayWindowWords*64 - 64, true},
+			{7 + replayWindowWords*64 - 64, false},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w replayWindow
+			for i, s := range tt.steps {
+				ok := w.check(s.counter)
+				if ok != s.ok {
+					t.Fatalf("step %d: check(%d) = %v, want %v", i, s.counter, ok, s.ok)
+				}
+				if ok {
+					w.update(s.counter)
+				}
+			}
+		})
+	}
+}
+
+// A counter is never accepted twice, however far the window moved since.
+func TestReplayWindowNeverTwice(t *testing.T) {
+	var w replayWindow
+	seen := make(map[uint64]bool)
+	counters := []uint64{0, 3, 64, 65, 2000, 1999, 1990, 4000, 3999, 70000, 69990, 3999}
+	for _, c := range counters {
+		if w.check(c) {
+			if seen[c] {
+				t.Fatalf("counter %d accepted twice", c)
+			}
+			seen[c] = true
+			w.update(c)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package sdtl
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// A server that restarted, or reaped a session, drops the frames of a
+// session it does not know. It tells the client with a USN, so the client
+// can handshake again instead of sending into the void. The USN is signed,
+// but signing is costly and the source of the frame unproven, so as with
+// HVR it takes a round trip: the server first answers with a challenge, the
+// session and a cookie for the source address, the client echoes it back
+// with its overlay address, and only then does the server sign it, with the
+// key the host expects the SHS to be signed with. The challenge is never
+// larger than the frame it answers, so it cannot be used to amplify, and
+// both are rate limited.
+const (
+	usnCkOffset  = 8
+	usnIPOffset  = 8 + cookieSize
+	usnSigOffset = 8 + cookieSize + 16
+
+	// USN of each kind the server sends in a second, by default
+	DefaultUnknownSessionRate = 20
+)
+
+type unknownSession struct {
+	version   byte // not on the wire; under protocolVerPrev there is no ip
+	session   [8]byte
+	cookie    [cookieSize]byte
+	ip        [16]byte // overlay address of the host, not in the challenge
+	signature []byte
+}
+
+// bodySize is the length of the echo, which is also the signed part of
+// the notice.
+func (usn *unknownSession) bodySize() int {
+	if usn.version == protocolVerPrev {
+		return usnIPOffset
+	}
+	return usnSigOffset
+}
+
+// rateLimit allows up to limit events in a second.
+type rateLimit struct {
+	limit  int
+	second time.Time
+	count  int
+}
+
+func (r *rateLimit) allow(now time.Time) bool {
+	if now.Sub(r.second) >= time.Second {
+		r.second = now
+		r.count = 0
+	}
+	if r.count >= r.limit {
+		return false
+	}
+	r.count++
+	return true
+}
+
+// challengeSession answers a sealed frame of a session nobody has with a
+// USN challenge in the version of the frame, or returns nil if the server
+// is over its rate. Under protocolVerPrev the notice is signed with the
+// server key, so there is no challenge without one.
+func (s *Server) challengeSession(msg *IOMessage, version byte, session [8]byte) *IOMessage {
+	if version == protocolVerPrev && s.priKey == nil {
+		return nil
+	}
+	if !s.challenges.allow(time.Now()) {
+		return nil
+	}
+	usn := unknownSession{version: version, session: session}
+	usn.cookie = s.cookies.issue(msg.addr, session[:])
+	data := append(msgHeader{version, msgUSN}.encode(), usn.encodeChallenge()...)
+	if len(data) >= msg.n {
+		// Never more than what came in
+		return nil
+	}
+	copy(msg.buffer[:], data)
+	msg.n = len(data)
+	return msg
+}
+
+// handleUnknownSession signs the USN a client echoed, once the cookie proves
+// the client owns its address and if the session is still unknown.
+func (s *Server) handleUnknownSession(msg *IOMessage) (*IOMessage, error) {
+	usn := unknownSession{version: msg.buffer[0]}
+	if e := usn.decode(msg.buffer[msgHeaderSize:msg.n], 0); e != nil {
+		return nil, errorf("handleUnknownSession", "malformed message", e)
+	}
+	if !s.cookies.verify(msg.addr, usn.session[:], usn.cookie[:]) {
+		return nil, errorf("handleUnknownSession", "invalid cookie", nil)
+	}
+	ct := getConnTable()
+	if _, e := ct.getConnectionBySession(usn.session); e == nil {
+		return nil, errorf("handleUnknownSession", "session known", nil)
+	}
+	// A PSK host takes nothing but its own key; a certified one is not
+	// known after a restart and takes the server key, as any other. Under
+	// protocolVerPrev the host is not known, and it is the server key
+	signkey := s.priKey
+	conn, e := ct.getConnectionByPrivate(extractIP(usn.ip[:]))
+	if usn.version != protocolVerPrev && e == nil && conn.signer != nil {
+		signkey = conn.signer
+	}
+	if signkey == nil {
+		return nil, errorf("handleUnknownSession", "no key to sign with", nil)
+	}
+	if !s.notices.allow(time.Now()) {
+		return nil, errorf("handleUnknownSession", "rate exceeded", nil)
+	}
+	data, e := packHandShakeMessage(signkey, usn.version, msgUSN, &usn)
+	if e != nil {
+		return nil, errorf("handleUnknownSession", "impossible to pack message", e)
+	}
+	copy(msg.buffer[:], data)
+	msg.n = len(data)
+	return msg, nil
+}
+
+// handleUnknownSession echoes a USN challenge for our session, at most once
+// a second, and handshakes again on a signed notice.
+func (s *Socket) handleUnknownSession(body []byte) error {
+	usn := unknownSession{version: s.version}
+	if usn.decodeChallenge(body) == nil {
+		if usn.session != s.session || time.Since(s.echoed) < time.Second {
+			return nil
+		}
+		s.echoed = time.Now()
+		copy(usn.ip[:], s.ip.To16())
+		s.conn.WriteToUDP(append(msgHeader{s.version, msgUSN}.encode(), usn.encode()...), s.raddr)
+		return nil
+	}
+	if usn.load(s.verifykey, body) != nil || usn.session != s.session {
+		return nil
+	}
+	if usn.version != protocolVerPrev && !s.ip.Equal(usn.ip[:]) {
+		return nil
+	}
+	return s.resume()
+}
+
+// resume handshakes again with a new session, from the Read that got the
+// notice. Writes in the meantime are dropped; on failure the socket is
+// closed.
+func (s *Socket) resume() error {
+	s.mu.Lock()
+	if s.encrypt == nil {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.release()
+	s.resuming = true
+	old := s.conn
+	s.mu.Unlock()
+
+	s.session = createRandomSession()
+	err := s.handShakeClient(s.addrs)
+	s.mu.Lock()
+	s.resuming = false
+	s.mu.Unlock()
+	old.Close()
+	if err != nil {
+		return fmt.Errorf("session lost: %w", err)
+	}
+	// The server opens its channels again from the start
+	s.channels.forgetPeer(io.EOF)
+	s.startKeepalive()
+	s.startProbing()
+	return nil
+}
@@ -0,0 +1,159 @@
+package sdtl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fingerprint identifies a public key in a revocation list: the hex SHA-256
+// of its PKIX encoding.
+func Fingerprint(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// revocationList holds the keys and certificates the server no longer
+// accepts. The file has one entry per line, "key <fingerprint>" or
+// "serial <hex serial>"; blank lines and lines starting with # are ignored.
+// It is read again whenever its modification time or size changes.
+type revocationList struct {
+	path    string
+	mtime   time.Time
+	size    int64
+	keys    map[string]bool
+	serials map[uint64]bool
+}
+
+func loadRevocationList(path string) (*revocationList, error) {
+	rl := &revocationList{path: path}
+	if _, err := rl.reload(); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// reload reads the file if it changed since the last time, and reports
+// whether it did. On error the list in force stays as it was.
+func (rl *revocationList) reload() (bool, error) {
+	fi, err := os.Stat(rl.path)
+	if err != nil {
+		return false, err
+	}
+	if rl.keys != nil && fi.ModTime().Equal(rl.mtime) && fi.Size() == rl.size {
+		return false, nil
+	}
+	data, err := os.ReadFile(rl.path)
+	if err != nil {
+		return false, err
+	}
+	keys, serials, err := parseRevocations(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", rl.path, err)
+	}
+	rl.keys = keys
+	rl.serials = serials
+	rl.mtime = fi.ModTime()
+	rl.size = fi.Size()
+	return true, nil
+}
+
+func parseRevocations(data []byte) (map[string]bool, map[uint64]bool, error) {
+	keys := make(map[string]bool)
+	serials := make(map[uint64]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("line %d: expected \"key <fingerprint>\" or \"serial <serial>\"", n)
+		}
+		value := strings.ToLower(fields[1])
+		switch fields[0] {
+		case "key":
+			if b, err := hex.DecodeString(value); err != nil || len(b) != sha256.Size {
+				return nil, nil, fmt.Errorf("line %d: invalid fingerprint", n)
+			}
+			keys[value] = true
+		case "serial":
+			serial, err := strconv.ParseUint(value, 16, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: invalid serial", n)
+			}
+			serials[serial] = true
+		default:
+			return nil, nil, fmt.Errorf("line %d: unknown entry %q", n, fields[0])
+		}
+	}
+	return keys, serials, scanner.Err()
+}
+
+// revoked reports whether the key, or the certificate when there is one, is
+// on the list. A nil list revokes nothing, and PSK keys have no fingerprint.
+func (rl *revocationList) revoked(key crypto.PublicKey, cert *Certificate) bool {
+	if rl == nil {
+		return false
+	}
+	if cert != nil && rl.serials[cert.Serial] {
+		return true
+	}
+	if _, ok := key.(pskMAC); ok || key == nil {
+		return false
+	}
+	fp, err := Fingerprint(key)
+	return err == nil && rl.keys[fp]
+}
+
+// revokedConnection is revoked for what the host last authenticated with.
+func (rl *revocationList) revokedConnection(conn *connection) bool {
+	if rl == nil {
+		return false
+	}
+	if conn.certified && rl.serials[conn.certSerial] {
+		return true
+	}
+	return rl.revoked(conn.publicKey, nil)
+}
+
+// reloadRevocations reads the revocation list again if it changed, and
+// closes every session or handshake of a host it now revokes, telling the
+// peer with a CLS.
+func (s *Server) reloadRevocations(send chan<- *IOMessage) {
+	changed, e := s.revoked.reload()
+	if e != nil {
+		log("ERROR: revocation list: %v", e)
+		return
+	}
+	if !changed {
+		return
+	}
+	log("INFO: Revocation list reloaded: %d keys, %d serials", len(s.revoked.keys), len(s.revoked.serials))
+	ct := getConnTable()
+	for _, conn := range ct.private {
+		if conn.state == ConnectionClose || !s.revoked.revokedConnection(conn) {
+			continue
+		}
+		log("INFO: Key revoked, closing: %s", conn.priAddr.String())
+		if conn.state == ConnectionReady && conn.encrypt != nil && conn.pubAddr != nil {
+			if msg, e := closeMessage(conn); e == nil {
+				send <- msg
+			}
+		}
+		ct.close(conn)
+	}
+}
@@ -0,0 +1,90 @@
+package sdtl
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRevocations(t *testing.T) {
+	fp := fmt.Sprintf("%064x", 1)
+	keys, serials, err := parseRevocations([]byte("# revoked\n\nkey " + fp + "\nserial 1F\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keys[fp] || !serials[0x1f] || len(keys) != 1 || len(serials) != 1 {
+		t.Fatalf("keys %v, serials %v", keys, serials)
+	}
+	for _, bad := range []string{
+		"key abc",
+		"key " + fp + " extra",
+		"serial xyz",
+		"cert 12",
+	} {
+		if _, _, err := parseRevocations([]byte(bad)); err == nil {
+			t.Fatalf("%q accepted", bad)
+		}
+	}
+}
+
+func TestRevocationList(t *testing.T) {
+	key, err := GenerateSigner(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateSigner(KeyTypeECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, err := Fingerprint(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "revoked")
+	if err := os.WriteFile(path, []byte("key "+fp+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rl, err := loadRevocationList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rl.revoked(key.Public(), nil) || rl.revoked(other.Public(), nil) {
+		t.Fatal("only the listed key is revoked")
+	}
+	psk, _ := pskKeys(bytes.Repeat([]byte{7}, pskMinSize), false)
+	if rl.revoked(psk, nil) {
+		t.Fatal("PSK keys have no fingerprint")
+	}
+	var none *revocationList
+	if none.revoked(key.Public(), nil) {
+		t.Fatal("a nil list revokes nothing")
+	}
+
+	if changed, err := rl.reload(); changed || err != nil {
+		t.Fatalf("unchanged file reloaded: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("serial 2a\nserial 2b\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := rl.reload(); !changed || err != nil {
+		t.Fatalf("changed file not reloaded: %v", err)
+	}
+	if rl.revoked(key.Public(), nil) {
+		t.Fatal("the key is no longer listed")
+	}
+	if !rl.revoked(other.Public(), &Certificate{Serial: 0x2a}) {
+		t.Fatal("the certificate serial is listed")
+	}
+
+	if err := os.WriteFile(path, []byte("serial 2a\nbogus\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rl.reload(); err == nil {
+		t.Fatal("invalid file accepted")
+	}
+	if !rl.revoked(other.Public(), &Certificate{Serial: 0x2a}) {
+		t.Fatal("a failed reload must keep the list in force")
+	}
+}
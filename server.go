@@ -1,47 +1,59 @@
 package sdtl
 
 import (
-	"crypto/ecdsa"
+	"bytes"
+	"crypto"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
 	"time"
 
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 type IOMessage struct {
+	udp    *net.UDPConn // socket the message came in on or goes out by
 	addr   *net.UDPAddr
 	n      int
 	buffer [2048]byte
 	err    error
 }
 
-func createRcv(udp *net.UDPConn) <-chan *IOMessage {
-	io := make(chan *IOMessage, 10)
-	go func() {
-		var buf [2048]byte
-		for {
-			n, a, e := udp.ReadFromUDP(buf[:])
-			if e != nil {
+// createRcv reads from every listening socket into a single channel.
+func createRcv(udps []*net.UDPConn) <-chan *IOMessage {
+	// Each reader ends with an error and a nil, which must not block once
+	// the loop is gone
+	io := make(chan *IOMessage, 10+2*len(udps))
+	for _, udp := range udps {
+		go func() {
+			var buf [2048]byte
+			for {
+				n, a, e := udp.ReadFromUDP(buf[:])
+				if e != nil {
+					msg := &IOMessage{
+						err: e,
+					}
+					io <- msg
+					break
+				}
 				msg := &IOMessage{
-					err: e,
+					udp:  udp,
+					addr: a,
+					n:    n,
 				}
+				copy(msg.buffer[:], buf[:n])
 				io <- msg
-				break
 			}
-			msg := &IOMessage{
-				addr: a,
-				n:    n,
-			}
-			copy(msg.buffer[:], buf[:n])
-			io <- msg
-		}
-		io <- nil
-	}()
+			io <- nil
+		}()
+	}
 	return io
 }
 
-func createSnd(udp *net.UDPConn) chan<- *IOMessage {
+func createSnd() chan<- *IOMessage {
 	io := make(chan *IOMessage)
 	go func() {
 		for {
@@ -49,7 +61,7 @@ func createSnd(udp *net.UDPConn) chan<- *IOMessage {
 			if msg == nil {
 				break
 			}
-			udp.WriteToUDP(msg.buffer[:msg.n], msg.addr)
+			msg.udp.WriteToUDP(msg.buffer[:msg.n], msg.addr)
 		}
 	}()
 	return io
@@ -59,78 +71,269 @@ func errorf(where string, message string, encap error) error {
 	return fmt.Errorf("in %s: %s, %v", where, message, encap)
 }
 
-func routeMsg(msg *IOMessage) (*IOMessage, error) {
-	ct := getConnTable()
+// innerDestination returns the destination of the tunneled IPv4 or IPv6
+// packet.
+func innerDestination(b []byte) (net.IP, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty packet")
+	}
+	switch b[0] >> 4 {
+	case ipv4.Version:
+		h, e := ipv4.ParseHeader(b)
+		if e != nil {
+			return nil, e
+		}
+		return h.Dst, nil
+	case ipv6.Version:
+		h, e := ipv6.ParseHeader(b)
+		if e != nil {
+			return nil, e
+		}
+		return h.Dst, nil
+	}
+	return nil, fmt.Errorf("unknown IP version %d", b[0]>>4)
+}
 
-	conn, e := ct.getConnectionByPublic(msg.addr)
+// openFrame finds the session a sealed frame belongs to and opens it,
+// returning the frame, whose header is authenticated, and its payload. The
+// source address plays no part in the lookup: a frame that authenticates
+// from a new address moves the session there, so clients survive NAT
+// rebinding and roaming.
+func openFrame(where string, msg *IOMessage) (*connection, *sealedFrame, []byte, error) {
+	ct := getConnTable()
 
+	session, e := frameSession(msg.buffer[:msg.n])
+	if e != nil {
+		return nil, nil, nil, errorf(where, "invalid message", e)
+	}
+	conn, e := ct.getConnectionBySession(session)
 	if e != nil || conn.state != ConnectionReady || conn.encrypt == nil {
-		return nil, errorf("routeMsg", "invalid state", e)
+		return nil, nil, nil, errorf(where, "invalid state", e)
+	}
+	f, e := parseFrame(msg.buffer[:msg.n], conn.encrypt.suite.saltSize)
+	if e != nil {
+		return nil, nil, nil, errorf(where, "invalid message", e)
+	}
+	var b []byte
+	conn.encrypt, b, e = conn.rekey.open(conn.encrypt, f)
+	if errors.Is(e, errReplayedFrame) {
+		conn.dropped++
+		return nil, nil, nil, errorf(where, fmt.Sprintf("replayed frame, %d dropped", conn.dropped), e)
+	}
+	if e != nil {
+		return nil, nil, nil, errorf(where, "invalid message", e)
 	}
+	if ct.migrate(conn, msg.udp, msg.addr) {
+		log("INFO: Session %x migrated to: %s", conn.session, msg.addr.String())
+	}
+	conn.mtime = time.Now()
+	return conn, f, b, nil
+}
 
-	b, e := loadDataFrame(conn.encrypt, msg.buffer[2:msg.n])
+func (s *Server) routeMsg(msg *IOMessage, send chan<- *IOMessage) (*IOMessage, error) {
+	conn, f, b, e := openFrame("routeMsg", msg)
 	if e != nil {
-		return nil, errorf("routeMsg", "invalid message", e)
+		return nil, e
 	}
 	fmt.Println(b)
-	iphdr, e := ipv4.ParseHeader(b)
+	if f.flags&dataFrameChannel != 0 {
+		return nil, s.deliverChannel(conn, b)
+	}
+	return nil, s.routePacket(b, send)
+}
+
+// handleFragment keeps the piece a FRG carries and routes the packet once
+// the last one is in.
+func (s *Server) handleFragment(msg *IOMessage, send chan<- *IOMessage) (*IOMessage, error) {
+	conn, f, b, e := openFrame("handleFragment", msg)
 	if e != nil {
-		return nil, errorf("routeMsg", "invalid encapsulated message", e)
+		return nil, e
 	}
-	conn.mtime = time.Now()
-	conn, e = ct.getConnectionByPrivate(iphdr.Dst)
+	if conn.caps&capFragment == 0 {
+		return nil, errorf("handleFragment", "fragmentation not negotiated", nil)
+	}
+	b, e = conn.frags.add(b, time.Now())
+	if e != nil {
+		return nil, errorf("handleFragment", "invalid fragment", e)
+	}
+	if b == nil {
+		return nil, nil
+	}
+	// The flags of the last piece, which are those of them all
+	if f.flags&dataFrameChannel != 0 {
+		return nil, s.deliverChannel(conn, b)
+	}
+	return nil, s.routePacket(b, send)
+}
+
+// routePacket seals a tunneled packet for the host it is addressed to, in
+// fragments if it does not fit in a datagram, and sends it.
+func (s *Server) routePacket(b []byte, send chan<- *IOMessage) error {
+	ct := getConnTable()
+
+	dst, e := innerDestination(b)
+	if e != nil {
+		return errorf("routeMsg", "invalid encapsulated message", e)
+	}
+	conn, e := ct.getConnectionByPrivate(dst)
 	if e != nil || conn.state != ConnectionReady || conn.encrypt == nil || conn.pubAddr == nil {
-		return nil, errorf("routeMsg", "not route to host", e)
+		return errorf("routeMsg", "not route to host", e)
 	}
-	msg.buffer[0] = ProtocolVer
-	msg.buffer[1] = msgDFE
-	tmp, e := dumpDataFrame(conn.encrypt, b)
+	return s.sendPacket(conn, 0, b, send)
+}
+
+// sendPacket seals a packet with flags for the ready session of conn, in
+// fragments if it does not fit in a datagram, and sends it.
+func (s *Server) sendPacket(conn *connection, flags byte, b []byte, send chan<- *IOMessage) error {
+	conn.fragID++
+	frames, e := sealPacket(conn.encrypt, conn.caps, flags, conn.fragID, b, conn.pmtu.size)
 	if e != nil {
-		return nil, errorf("routeMsg", "impossible dump message", e)
+		return errorf("routeMsg", "impossible dump message", e)
 	}
-	copy(msg.buffer[2:], tmp)
-	msg.n = len(tmp) + 2
-	msg.addr = conn.pubAddr
-	return msg, nil
+	for _, frame := range frames {
+		msg := &IOMessage{
+			udp:  conn.udp,
+			addr: conn.pubAddr,
+			n:    len(frame),
+		}
+		copy(msg.buffer[:], frame)
+		send <- msg
+	}
+	return nil
 }
 
-func handleSTR(signkey *ecdsa.PrivateKey, msg *IOMessage) (*IOMessage, error) {
+func handleSTR(signkey crypto.Signer, ca crypto.PublicKey, revoked *revocationList, skew time.Duration, msg *IOMessage) (*IOMessage, error) {
 	var (
 		start startHandShake
 		hsmsg handShake
+		cert  *Certificate
 	)
 	ct := getConnTable()
-	ip := extractIP(msg.buffer[2:])
+	body := msg.buffer[msgHeaderSize:msg.n]
+	// Unsigned yet, but it tells which key has to have signed it
+	if _, e := start.decode(body, 0); e != nil {
+		return nil, errorf("handleSTR", "malformed message", e)
+	}
+	ip := extractIP(start.ip[:])
 	fmt.Println(ip)
 	conn, e := ct.getConnectionByPrivate(ip)
+	key := strKey(&start, conn)
+	if key == nil {
+		return nil, errorf("handleSTR", "public ket not found", e)
+	}
+	// Anyone can forge a STR, so nothing is signed for one that is not
+	// signed in turn: it is dropped without a word
+	e = start.load(key, body)
 	if e != nil {
-		return nil, errorf("handleSTR", "private address not found", e)
+		return nil, errorf("handleSTR", "loading message", e)
 	}
-
-	if conn.publicKey == nil {
-		return nil, errorf("handleSTR", "public ket not found", nil)
+	// Nothing may follow but the cookie
+	if rest := len(body) - start.size(); rest != 0 && rest != cookieSize {
+		return nil, errorf("handleSTR", "malformed message", errMalformed)
 	}
-
-	e = start.load(conn.publicKey, msg.buffer[2:])
+	// A refused STR is answered with a REJ, signed with the key the client
+	// expects the SHS to be signed with
+	rejkey := signkey
+	if conn != nil && conn.signer != nil {
+		rejkey = conn.signer
+	}
+	if start.cert != nil {
+		if ca == nil {
+			return rejectSTR(rejkey, start.session, rejectUnauthorized, msg),
+				errorf("handleSTR", "certificates not accepted", nil)
+		}
+		cert, e = verifyCertificate(start.cert, ca, time.Now())
+		if e != nil {
+			return rejectSTR(rejkey, start.session, rejectUnauthorized, msg),
+				errorf("handleSTR", "invalid certificate", e)
+		}
+		if !cert.IP.Equal(ip) {
+			return rejectSTR(rejkey, start.session, rejectUnauthorized, msg),
+				errorf("handleSTR", "certificate for another address", nil)
+		}
+		if conn != nil && !conn.certified {
+			return rejectSTR(rejkey, start.session, rejectUnauthorized, msg),
+				errorf("handleSTR", "address configured for another host", nil)
+		}
+	}
+	if revoked.revoked(key, cert) {
+		return rejectSTR(rejkey, start.session, rejectUnauthorized, msg),
+			errorf("handleSTR", "revoked host", nil)
+	}
+	if cert != nil {
+		// Signed by the key in the certificate, the host is who it claims
+		conn, e = ct.addCertified(cert)
+		if e != nil {
+			return nil, errorf("handleSTR", "adding certified host", e)
+		}
+	}
+	if conn.signer != nil {
+		signkey = conn.signer
+	}
+	strLen := 2 + start.size()
+	if conn.state == HandShakeServerSent && conn.session == start.session &&
+		len(conn.transcript) > strLen && bytes.Equal(conn.transcript[:strLen], msg.buffer[:strLen]) {
+		// A retransmission, or the client racing several of our addresses:
+		// the same STR gets the same SHS, from whichever address it came
+		shs := conn.transcript[strLen:]
+		ct.addPublic(msg.addr, conn)
+		copy(msg.buffer[:], shs)
+		msg.n = len(shs)
+		return msg, nil
+	}
+	now := time.Now()
+	e = start.checkTimestamp(now, skew)
 	if e != nil {
-		return nil, errorf("handleSTR", "loading message", e)
+		return rejectSTR(signkey, start.session, rejectRefused, msg),
+			errorf("handleSTR", "stale message", e)
+	}
+	if conn.replayedSTR(start.session, now.Add(2*skew)) {
+		return nil, errorf("handleSTR", "replayed message", nil)
 	}
+	// Only the suites configured for the host are on the table
+	version, caps, e := negotiate(start.versions, start.caps&^(capSuites&^conn.suites))
+	if e != nil {
+		return rejectSTR(signkey, start.session, rejectVersion, msg),
+			errorf("handleSTR", "negotiating", e)
+	}
+	if other, e := ct.getConnectionBySession(start.session); e == nil && other != conn {
+		return rejectSTR(signkey, start.session, rejectRefused, msg),
+			errorf("handleSTR", "duplicated session", nil)
+	}
+	// A new handshake ends whatever session the host had
+	ct.dropSession(conn)
 
 	conn.encrypt, e = newCipher()
 	if e != nil {
 		return nil, errorf("handleSTR", "creating a new cipher", e)
 	}
+	conn.encrypt.version = version
+	conn.encrypt.session = start.session
+	conn.encrypt.suite = suiteByCap(caps)
+	conn.caps = caps
 	conn.session = start.session
+	conn.udp = msg.udp
 	conn.pubAddr = msg.addr
 	hsmsg.session = start.session
+	hsmsg.version = version
+	hsmsg.caps = caps
 	copy(hsmsg.epk[:], conn.encrypt.PublicKey())
-	data, e := packHandShakeMessage(signkey, msgSHS, &hsmsg)
+	if caps&capHybrid != 0 {
+		hsmsg.kem, e = conn.encrypt.encapsulate(start.ek)
+	}
+	var data []byte
+	if e == nil {
+		data, e = packHandShakeMessage(signkey, version, msgSHS, &hsmsg)
+	}
 	if e != nil {
 		conn.session = [8]byte{}
 		conn.encrypt = nil
 		conn.pubAddr = nil
 		return nil, errorf("handleSTR", "impossible to pack message", e)
 	}
+	conn.transcript = make([]byte, 0, strLen+len(data))
+	conn.transcript = append(conn.transcript, msg.buffer[:strLen]...)
+	conn.transcript = append(conn.transcript, data...)
 	conn.state = HandShakeServerSent
 	conn.mtime = time.Now()
 	ct.addPublic(msg.addr, conn)
@@ -139,30 +342,193 @@ func handleSTR(signkey *ecdsa.PrivateKey, msg *IOMessage) (*IOMessage, error) {
 	return msg, nil
 }
 
-func handleCHS(msg *IOMessage) error {
+func (s *Server) handleCHS(msg *IOMessage) (*IOMessage, error) {
 	var (
 		hsmsg handShake
+		done  handShakeDone
 	)
 
 	ct := getConnTable()
 
 	conn, e := ct.getConnectionByPublic(msg.addr)
 	if e != nil {
-		return fmt.Errorf("handleCHS(); public connection not found")
+		return nil, fmt.Errorf("handleCHS(); public connection not found")
+	}
+	signkey := s.priKey
+	if conn.signer != nil {
+		signkey = conn.signer
+	}
+	chs := msg.buffer[:min(msg.n, 2+xhsSigOffset+signatureSize(conn.publicKey))]
+	if conn.state == ConnectionReady && bytes.Equal(conn.chs, chs) {
+		// Our HSD got lost and the client sent CHS again
+		copy(msg.buffer[:], conn.hsd)
+		msg.n = len(conn.hsd)
+		return msg, nil
 	}
 	if conn.state != HandShakeServerSent {
-		return fmt.Errorf("handleCHS(): received a CHS in a different state: %d", conn.state)
+		return nil, fmt.Errorf("handleCHS(): received a CHS in a different state: %d", conn.state)
 	}
-	e = hsmsg.load(conn.publicKey, msg.buffer[2:])
-	if e != nil || hsmsg.session != conn.session {
-		return fmt.Errorf("handleCHS(): invalid session - error(%v)", e)
+	e = hsmsg.load(conn.publicKey, msg.buffer[msgHeaderSize:msg.n])
+	if e != nil || hsmsg.session != conn.session || len(hsmsg.kem) != 0 {
+		return nil, fmt.Errorf("handleCHS(): invalid session - error(%v)", e)
+	}
+	if hsmsg.version != conn.encrypt.version || hsmsg.caps != conn.caps {
+		return nil, fmt.Errorf("handleCHS(): negotiated parameters do not match")
 	}
 	e = conn.encrypt.SharedSecret(hsmsg.epk[:])
 	if e != nil {
-		return fmt.Errorf("handleCHS(): creating shared secret - error(%v)", e)
+		return nil, fmt.Errorf("handleCHS(): creating shared secret - error(%v)", e)
+	}
+	th := transcriptHash(conn.transcript, chs)
+	conn.encrypt.psk = conn.psk
+	e = conn.encrypt.DeriveKeys(conn.session[:], th, false)
+	if e != nil {
+		return nil, fmt.Errorf("handleCHS(): deriving session keys - error(%v)", e)
 	}
+	done.session = conn.session
+	copy(done.transcript[:], th)
+	copy(done.mac[:], confirmKeys(conn.encrypt.confirm, th))
+	data, e := packHandShakeMessage(signkey, conn.encrypt.version, msgHSD, &done)
+	if e != nil {
+		return nil, fmt.Errorf("handleCHS(): packing handshake done - error(%v)", e)
+	}
+	conn.chs = append([]byte(nil), chs...)
+	conn.hsd = data
+	conn.transcript = nil
+	conn.rekey = rekeyState{}
+	conn.frags = reassembly{}
+	conn.pmtu.startDiscovery(conn.caps, s.maxDatagram)
+	// The client settled on this address, forget any other it tried
+	ct.dropPublic(conn)
+	conn.udp = msg.udp
+	conn.pubAddr = msg.addr
+	ct.addPublic(msg.addr, conn)
+	ct.addSession(conn)
 	conn.state = ConnectionReady
-	return nil
+	// Channels belong to the session they were opened in
+	conn.channels.close(io.EOF)
+	conn.channels = newChannelSet(s, conn.priAddr, 2, s.accepted)
+	conn.mtime = time.Now()
+	copy(msg.buffer[:], data)
+	msg.n = len(data)
+	return msg, nil
+}
+
+func handleRekey(msg *IOMessage) (*IOMessage, error) {
+	conn, f, b, e := openFrame("handleRekey", msg)
+	if e != nil {
+		return nil, e
+	}
+	if conn.caps&capRekey == 0 {
+		return nil, errorf("handleRekey", "rekey not negotiated", nil)
+	}
+	epk, e := decodeRekey(b)
+	if e != nil {
+		return nil, errorf("handleRekey", "invalid key", e)
+	}
+
+	if f.msgType == msgRKS {
+		conn.encrypt, e = conn.rekey.complete(conn.encrypt, epk, false)
+		if e != nil {
+			return nil, errorf("handleRekey", "completing rekey", e)
+		}
+		return nil, nil
+	}
+
+	reply, e := conn.rekey.answer(conn.encrypt, epk, false)
+	if e != nil {
+		return nil, errorf("handleRekey", "answering rekey", e)
+	}
+	if reply == nil {
+		return nil, nil
+	}
+	copy(msg.buffer[:], reply)
+	msg.n = len(reply)
+	msg.udp = conn.udp
+	msg.addr = conn.pubAddr
+	return msg, nil
+}
+
+// handleKeepalive only has to open the frame, which refreshes mtime and
+// follows the client to a new address.
+func handleKeepalive(msg *IOMessage) (*IOMessage, error) {
+	_, _, _, e := openFrame("handleKeepalive", msg)
+	return nil, e
+}
+
+// handleClose tears down the session named by an authenticated CLS.
+func handleClose(msg *IOMessage) (*IOMessage, error) {
+	conn, _, _, e := openFrame("handleClose", msg)
+	if e != nil {
+		return nil, e
+	}
+	log("INFO: Session closed by: %s", conn.priAddr.String())
+	getConnTable().close(conn)
+	return nil, nil
+}
+
+// closeMessage seals a CLS for conn, which must still hold its keys.
+func closeMessage(conn *connection) (*IOMessage, error) {
+	data, e := packDataFrame(conn.encrypt, msgCLS, nil)
+	if e != nil {
+		return nil, errorf("closeMessage", "sealing close", e)
+	}
+	msg := &IOMessage{
+		udp:  conn.udp,
+		addr: conn.pubAddr,
+		n:    len(data),
+	}
+	copy(msg.buffer[:], data)
+	return msg, nil
+}
+
+// closeSessions sends a CLS to every ready session and releases it. The
+// messages are written directly so they leave before the sockets close.
+func (s *Server) closeSessions() {
+	ct := getConnTable()
+	for _, conn := range ct.private {
+		if conn.state != ConnectionReady || conn.encrypt == nil || conn.pubAddr == nil {
+			continue
+		}
+		msg, e := closeMessage(conn)
+		if e == nil {
+			_, e = msg.udp.WriteToUDP(msg.buffer[:msg.n], msg.addr)
+		}
+		if e != nil {
+			log("ERROR: close %s: %v", conn.priAddr.String(), e)
+		}
+		ct.close(conn)
+	}
+}
+
+// rekeySessions sends an RKQ on every ready session whose key is due, and
+// repeats the ones still waiting for an answer.
+func (s *Server) rekeySessions(send chan<- *IOMessage) {
+	ct := getConnTable()
+	for _, conn := range ct.private {
+		if conn.state != ConnectionReady || conn.encrypt == nil || conn.pubAddr == nil {
+			continue
+		}
+		if conn.caps&capRekey == 0 {
+			continue
+		}
+		data, e := conn.rekey.request(conn.encrypt, s.rekeyAfter, s.rekeyBytes)
+		if e != nil {
+			log("ERROR: rekey %s: %v", conn.priAddr.String(), e)
+			continue
+		}
+		if data == nil {
+			continue
+		}
+		log("INFO: Rekey request to: %s", conn.pubAddr.String())
+		msg := &IOMessage{
+			udp:  conn.udp,
+			addr: conn.pubAddr,
+			n:    len(data),
+		}
+		copy(msg.buffer[:], data)
+		send <- msg
+	}
 }
 
 func log(format string, v ...interface{}) {
@@ -171,38 +537,102 @@ func log(format string, v ...interface{}) {
 	fmt.Println(message)
 }
 
+// handleMessage hands a datagram to the handler for its type, and returns
+// the answer to send back, if any.
+func (s *Server) handleMessage(msg *IOMessage, send chan<- *IOMessage) (*IOMessage, error) {
+	hdr, _, e := parseHeader(msg.buffer[:msg.n])
+	if e != nil {
+		return nil, errorf("handleMessage", "invalid message from "+msg.addr.String(), e)
+	}
+	// A STR lists its versions in the body, so its header is not checked
+	if hdr.msgType != msgSTR && !isSupportedVersion(hdr.version) {
+		return nil, errorf("handleMessage", "protocol missmatch from "+msg.addr.String(), nil)
+	}
+	switch hdr.msgType {
+	case msgRKQ, msgRKS, msgKAL, msgPRB, msgPRA, msgDFE, msgFRG:
+		// Most likely a client of ours from before a restart
+		session, e := frameSession(msg.buffer[:msg.n])
+		if _, err := getConnTable().getConnectionBySession(session); e == nil && err != nil {
+			return s.challengeSession(msg, hdr.version, session), errorf("handleMessage", "unknown session from "+msg.addr.String(), nil)
+		}
+	}
+	switch hdr.msgType {
+	case msgSTR:
+		if rej, ok := s.rejectUnknown(msg); ok {
+			return rej, errorf("handleMessage", "unknown host from "+msg.addr.String(), nil)
+		}
+		if hvr, ok := s.cookies.checkCookie(msg); !ok {
+			return hvr, nil
+		}
+		log("INFO: Start Handshake from: %s", msg.addr.String())
+		return handleSTR(s.priKey, s.ca, s.revoked, s.handshakeSkew, msg)
+	case msgCHS:
+		log("INFO: Client Handshake from: %s", msg.addr.String())
+		return s.handleCHS(msg)
+	case msgRKQ, msgRKS:
+		return handleRekey(msg)
+	case msgCLS:
+		return handleClose(msg)
+	case msgKAL:
+		return handleKeepalive(msg)
+	case msgPRB, msgPRA:
+		return handleProbe(msg)
+	case msgDFE:
+		// Data Frame Encripted
+		fmt.Println(msg)
+		return s.routeMsg(msg, send)
+	case msgFRG:
+		return s.handleFragment(msg, send)
+	case msgUSN:
+		return s.handleUnknownSession(msg)
+	}
+	return nil, errorf("handleMessage", "unexpected message from "+msg.addr.String(), nil)
+}
+
 func (s *Server) ListenAndServe() {
 	var (
 		err error
 	)
 	recv := createRcv(s.udp)
-	send := createSnd(s.udp)
+	send := createSnd()
+	quit := s.quit
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	// However the loop ends, whoever waits on it must not wait forever
+	defer s.Close()
 
 	for {
-		msg := <-recv
+		var msg *IOMessage
+		select {
+		case msg = <-recv:
+		case f := <-s.control:
+			f(send)
+			continue
+		case <-ticker.C:
+			s.rekeySessions(send)
+			s.reapSessions(send)
+			s.probeSessions(send)
+			if s.revoked != nil {
+				s.reloadRevocations(send)
+			}
+			continue
+		case <-quit:
+			s.closeSessions()
+			for _, udp := range s.udp {
+				udp.Close()
+			}
+			quit = nil
+			continue
+		}
+		if msg.err != nil && quit == nil {
+			log("INFO: Server closed")
+			break
+		}
 		if msg.err != nil {
 			log("ERROR: fatal error: %v - Exit", msg.err)
 			break
 		}
-		if msg.buffer[0] != ProtocolVer {
-			log("ERROR: protocol missmatch from %s - Drop", msg.addr.String())
-			continue
-		}
-		switch msg.buffer[1] {
-		case msgSTR:
-			log("INFO: Start Handshake from: %s", msg.addr.String())
-			msg, err = handleSTR(s.priKey, msg)
-		case msgCHS:
-			log("INFO: Client Handshake from: %s", msg.addr.String())
-			err = handleCHS(msg)
-			msg = nil
-		case msgDFE:
-			// Data Frame Encripted
-			fmt.Println(msg)
-			msg, err = routeMsg(msg)
-
-		}
-
+		msg, err = s.handleMessage(msg, send)
 		if err != nil {
 			log("ERROR: message %v - Drop", err)
 		}
@@ -217,40 +647,163 @@ func (s *Server) ListenAndServe() {
 }
 
 type Server struct {
-	udp    *net.UDPConn
-	priKey *ecdsa.PrivateKey
+	udp        []*net.UDPConn
+	priKey     crypto.Signer
+	rekeyAfter time.Duration
+	rekeyBytes uint64
+	cookies    *cookieJar
+	// Dead sessions and handshakes are reaped after these
+	idleTimeout      time.Duration
+	handshakeTimeout time.Duration
+	handshakeSkew    time.Duration
+	ca               crypto.PublicKey // trusted to issue host certificates
+	revoked          *revocationList
+	maxDatagram      int
+	// Frames of unknown sessions are answered within these, see resume.go
+	challenges rateLimit
+	notices    rateLimit
+	// STR of unknown hosts are refused within this, see reject.go
+	unknownHosts rateLimit
+	// Channels opened by hosts, and the work of channels for the loop,
+	// see channel.go
+	accepted chan *Channel
+	control  chan func(send chan<- *IOMessage)
+	quit     chan struct{}
+	closing  sync.Once
 }
 
-func SDTLServer(config string) (*Server, error) {
-	cfg, err := ParseConfig(config)
-	if err != nil {
-		return nil, err
-	}
+// Close ends every session with a CLS and makes ListenAndServe return.
+func (s *Server) Close() {
+	s.closing.Do(func() { close(s.quit) })
+}
 
-	pk, err := PrivateFromPemFile(cfg.Server.PrivateKey)
-	if err != nil {
+// listenAll opens one socket per address, of either family, with DF set
+// for path MTU discovery. On error the sockets already opened are closed.
+func listenAll(addresses []string) ([]*net.UDPConn, error) {
+	var udps []*net.UDPConn
+	for _, address := range addresses {
+		addr, err := net.ResolveUDPAddr("udp", address)
+		if err == nil {
+			var c *net.UDPConn
+			c, err = net.ListenUDP("udp", addr)
+			if err == nil {
+				udps = append(udps, c)
+				err = setDontFragment(c)
+			}
+			if err == nil {
+				continue
+			}
+		}
+		for _, c := range udps {
+			c.Close()
+		}
 		return nil, err
 	}
-	addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", cfg.Server.Listen, cfg.Server.Port))
+	if len(udps) == 0 {
+		return nil, fmt.Errorf("no listen address configured")
+	}
+	return udps, nil
+}
+
+func SDTLServer(config string) (*Server, error) {
+	cfg, err := ParseConfig(config)
 	if err != nil {
 		return nil, err
 	}
 
-	c, err := net.ListenUDP("udp4", addr)
+	// Not needed when every host uses a PSK alone
+	var pk crypto.Signer
+	if cfg.Server.PrivateKey != "" {
+		pk, err = PrivateFromPemFile(cfg.Server.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cookies, err := newCookieJar(cfg.Server.CookieThreshold)
 	if err != nil {
 		return nil, err
 	}
 	ct := getConnTable()
 	for _, host := range cfg.Hosts {
-		pb, e := PublicKeyFromPemFile(host.PublicKey)
+		auth, e := host.auth()
 		if e != nil {
 			return nil, e
 		}
+		if auth.publicKey != nil && pk == nil {
+			return nil, fmt.Errorf("host %s needs the server private key", host.IP)
+		}
 		ip := net.ParseIP(host.IP)
-		ct.addPrivate(ip, pb)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host address: %s", host.IP)
+		}
+		suites, e := suitesByName(host.CipherSuites...)
+		if e != nil {
+			return nil, e
+		}
+		if e = ct.addPrivate(ip, auth, suites); e != nil {
+			return nil, fmt.Errorf("host %s: %v", host.IP, e)
+		}
+	}
+	srv := &Server{
+		priKey:           pk,
+		rekeyAfter:       DefaultRekeyAfter,
+		rekeyBytes:       DefaultRekeyBytes,
+		cookies:          cookies,
+		quit:             make(chan struct{}),
+		idleTimeout:      DefaultIdleTimeout,
+		handshakeTimeout: DefaultHandshakeTimeout,
+		handshakeSkew:    DefaultHandshakeSkew,
+		maxDatagram:      DefaultMaxDatagram,
+		challenges:       rateLimit{limit: DefaultUnknownSessionRate},
+		notices:          rateLimit{limit: DefaultUnknownSessionRate},
+		unknownHosts:     rateLimit{limit: DefaultUnknownHostRate},
+		accepted:         make(chan *Channel, channelQueue),
+		control:          make(chan func(send chan<- *IOMessage)),
+	}
+	if cfg.Server.CA != "" {
+		if pk == nil {
+			return nil, fmt.Errorf("a CA needs the server private key")
+		}
+		srv.ca, err = PublicKeyFromPemFile(cfg.Server.CA)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Server.Revocations != "" {
+		srv.revoked, err = loadRevocationList(cfg.Server.Revocations)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Server.MaxDatagram > 0 {
+		if err = checkDatagram(cfg.Server.MaxDatagram); err != nil {
+			return nil, err
+		}
+		srv.maxDatagram = cfg.Server.MaxDatagram
+	}
+	if cfg.Server.UnknownSessionRate > 0 {
+		srv.challenges.limit = cfg.Server.UnknownSessionRate
+		srv.notices.limit = cfg.Server.UnknownSessionRate
+	}
+	if cfg.Server.RekeyAfter > 0 {
+		srv.rekeyAfter = time.Duration(cfg.Server.RekeyAfter) * time.Second
+	}
+	if cfg.Server.RekeyBytes > 0 {
+		srv.rekeyBytes = cfg.Server.RekeyBytes
+	}
+	if cfg.Server.IdleTimeout > 0 {
+		srv.idleTimeout = time.Duration(cfg.Server.IdleTimeout) * time.Second
+	}
+	if cfg.Server.HandshakeTimeout > 0 {
+		srv.handshakeTimeout = time.Duration(cfg.Server.HandshakeTimeout) * time.Second
+	}
+	if cfg.Server.HandshakeSkew > 0 {
+		srv.handshakeSkew = time.Duration(cfg.Server.HandshakeSkew) * time.Second
+	}
+	// Last, so no error above leaves them open
+	srv.udp, err = listenAll(cfg.Server.listenAddresses())
+	if err != nil {
+		return nil, err
 	}
-	return &Server{
-		udp:    c,
-		priKey: pk,
-	}, nil
+	return srv, nil
 }
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"os/signal"
 	"sdtl"
+	"syscall"
 )
 
 func main() {
@@ -11,5 +14,11 @@ func main() {
 		fmt.Println(e)
 		return
 	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		s.Close()
+	}()
 	s.ListenAndServe()
 }
@@ -0,0 +1,27 @@
+package sdtl
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServerDuplicateHost(t *testing.T) {
+	psk := strings.Repeat("ab", pskMinSize)
+	config := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(config, []byte(`{"server": {"addresses": ["127.0.0.1:0"]}, "hosts": [
+		{"ip": "10.9.8.1", "psk": "`+psk+`"},
+		{"ip": "10.9.8.1", "psk": "`+psk+`"}]}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		key, _ := ipKey(net.ParseIP("10.9.8.1"))
+		delete(getConnTable().private, key)
+	})
+	if _, err := SDTLServer(config); err == nil {
+		t.Fatal("a host configured twice must be refused")
+	}
+}
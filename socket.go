@@ -1,82 +1,173 @@
 package sdtl
 
 import (
-	"crypto/ecdsa"
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/mlkem"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Socket struct {
-	signerkey *ecdsa.PrivateKey
-	verifykey *ecdsa.PublicKey
-	raddr     *net.UDPAddr
-	conn      *net.UDPConn
-	ip        net.IP
-	connected bool
-	session   [8]byte
-	encrypt   *aesCipher
-}
-
-func packHandShakeMessage(signerkey *ecdsa.PrivateKey, msgType uint, msg handShakeInterface) ([]byte, error) {
-	pack := make([]byte, 2+msg.size())
+	signerkey  crypto.Signer
+	verifykey  crypto.PublicKey
+	raddr      *net.UDPAddr
+	conn       *net.UDPConn
+	ip         net.IP
+	connected  bool
+	session    [8]byte
+	version    byte
+	caps       uint32
+	mu         sync.Mutex // guards encrypt and rekey
+	encrypt    *aesCipher
+	rekey      rekeyState
+	rekeyAfter time.Duration
+	rekeyBytes uint64
+	keepalive  time.Duration
+	hybrid     bool
+	suites     uint32        // cipher suites offered
+	psk        []byte        // mixed into the key derivation
+	cert       []byte        // presented in the STR, when set
+	stop       chan struct{} // ends the keepalive loop, guarded by mu
+	closed     bool          // guarded by mu
+	dropped    atomic.Uint64
+	// Larger packets are fragmented, see fragment.go
+	maxDatagram int
+	fragID      atomic.Uint32
+	frags       reassembly // guarded by mu
+	pmtu        pmtuState  // guarded by mu
+	onMTU       func(mtu int)
+	// The server forgot the session, see resume.go
+	addrs    []*net.UDPAddr
+	resuming bool // guarded by mu
+	echoed   time.Time
+	// Channels of the session, the main pipe is channel 0, see channel.go.
+	// Whoever holds reading reads the network, into inbuf.
+	channels *channelSet // guarded by mu
+	main     *Channel    // guarded by mu
+	reading  chan struct{}
+	inbuf    [maxDatagram]byte
+}
+
+func packHandShakeMessage(signerkey crypto.Signer, version byte, msgType uint, msg handShakeInterface) ([]byte, error) {
 	body, err := msg.dump(signerkey)
 	if err != nil {
 		return nil, err
 	}
-	pack[0] = ProtocolVer
-	pack[1] = byte(msgType)
-	copy(pack[2:], body)
-	return pack, nil
+	return append(msgHeader{version, byte(msgType)}.encode(), body...), nil
 }
 
-func (c *Socket) packHandShakeMessage(msgType uint, msg handShakeInterface) ([]byte, error) {
-	return packHandShakeMessage(c.signerkey, msgType, msg)
+func (c *Socket) packHandShakeMessage(version byte, msgType uint, msg handShakeInterface) ([]byte, error) {
+	return packHandShakeMessage(c.signerkey, version, msgType, msg)
 }
 
-func NewSocketClient(key *ecdsa.PrivateKey) (*Socket, error) {
+func NewSocketClient(key crypto.Signer) (*Socket, error) {
 	return newSocket(key)
 }
 
-func newSocket(key *ecdsa.PrivateKey) (*Socket, error) {
+func newSocket(key crypto.Signer) (*Socket, error) {
 	var (
 		s Socket
 	)
 	s.signerkey = key
+	s.rekeyAfter = DefaultRekeyAfter
+	s.rekeyBytes = DefaultRekeyBytes
+	s.keepalive = DefaultKeepalive
+	s.hybrid = true
+	s.suites = capSuites & supportedCaps
+	s.maxDatagram = DefaultMaxDatagram
+	s.reading = make(chan struct{}, 1)
 	return &s, nil
 }
 
-func (s *Socket) Connect(to string, key *ecdsa.PublicKey, ip string) error {
-	var (
-		e error
-	)
+// SetHybrid chooses whether the next Connect offers the hybrid ML-KEM
+// exchange. It is on by default; turning it off keeps the STR small.
+func (s *Socket) SetHybrid(on bool) {
+	s.hybrid = on
+}
+
+// SetCipherSuites limits the cipher suites the next Connect offers, by name:
+// "aes-gcm", "chacha20-poly1305" or "xchacha20-poly1305". The server picks
+// one of them; with no names every suite is offered.
+func (s *Socket) SetCipherSuites(names ...string) error {
+	suites, err := suitesByName(names...)
+	if err != nil {
+		return err
+	}
+	s.suites = suites
+	return nil
+}
+
+// SetMaxDatagram sets the largest UDP payload the socket sends, which is as
+// far as path MTU discovery goes. Packets that do not fit are sent in
+// fragments the server puts back together. It takes effect on the next
+// Connect.
+func (s *Socket) SetMaxDatagram(size int) error {
+	if err := checkDatagram(size); err != nil {
+		return err
+	}
+	s.maxDatagram = size
+	return nil
+}
+
+// SetRekey sets the age and the number of bytes after which the socket
+// rekeys the session. Zero keeps the current value.
+func (s *Socket) SetRekey(after time.Duration, volume uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if after > 0 {
+		s.rekeyAfter = after
+	}
+	if volume > 0 {
+		s.rekeyBytes = volume
+	}
+}
+
+func (s *Socket) Connect(to string, key crypto.PublicKey, ip string) error {
 	if to == "" {
 		return fmt.Errorf("invalid address value")
 	}
 
-	s.raddr, e = net.ResolveUDPAddr("udp4", to)
+	addrs, e := resolveUDP(to)
 	if e != nil {
 		return e
 	}
 
-	s.verifykey = key
-	s.conn, e = net.ListenUDP("udp4", nil)
-	if e != nil {
-		return e
+	if key != nil {
+		s.verifykey = key
+	}
+	if s.verifykey == nil {
+		return fmt.Errorf("no server key")
 	}
 	s.ip = net.ParseIP(ip)
+	if s.ip == nil {
+		return fmt.Errorf("invalid overlay address: %s", ip)
+	}
+	s.mu.Lock()
+	s.closed = false
+	s.channels.close(net.ErrClosed)
+	s.channels = nil
+	s.mu.Unlock()
+	s.addrs = addrs
 	s.session = createRandomSession()
-	e = s.handShakeClient()
+	e = s.handShakeClient(addrs)
 	if e != nil {
-		s.conn.Close()
+		return e
 	}
-
-	return e
+	s.startKeepalive()
+	s.startProbing()
+	return nil
 }
 
-func (s *Socket) readFromUDP() ([]byte, *net.UDPAddr, error) {
+func readFromUDP(conn *net.UDPConn) ([]byte, *net.UDPAddr, error) {
 	buf := make([]byte, 2048)
-	n, addr, e := s.conn.ReadFromUDP(buf)
+	n, addr, e := conn.ReadFromUDP(buf)
 	if e != nil {
 		return nil, addr, e
 	}
@@ -84,117 +175,471 @@ func (s *Socket) readFromUDP() ([]byte, *net.UDPAddr, error) {
 	return buf[:n], addr, nil
 }
 
-func (s *Socket) handShakeClient() error {
+// helloResult is what a successful STR/SHS exchange with one of the server
+// addresses leaves for the rest of the handshake.
+type helloResult struct {
+	conn   *net.UDPConn
+	raddr  *net.UDPAddr
+	hsmsg  handShake
+	shsPkg []byte
+}
+
+// hello sends the STR to raddr until a valid SHS comes back, answering the
+// HVR cookie challenge if the server asks for it.
+func (s *Socket) hello(conn *net.UDPConn, raddr *net.UDPAddr, start *startHandShake, strPkg []byte) (*helloResult, error) {
 	var (
-		start startHandShake
 		hsmsg handShake
 	)
-
-	start.session = s.session
-	copy(start.ip[:], s.ip.To4())
-	pkg, err := s.packHandShakeMessage(msgSTR, &start)
-	if err != nil {
-		return err
-	}
-	success := false
+	pkg := strPkg
 	timeout := time.Second
 	// 1 Sec of tollerance
-	s.conn.SetReadDeadline(time.Now().Add(timeout))
-	for tries := 3; tries > 0 && !success; tries-- {
-		_, err = s.conn.WriteToUDP(pkg, s.raddr)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for tries := 3; tries > 0; tries-- {
+		_, err := conn.WriteToUDP(pkg, raddr)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		for {
-			data, addr, err := s.readFromUDP()
+			data, addr, err := readFromUDP(conn)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					// Stablish again 1 sec of tolerance
 					timeout *= 2
-					s.conn.SetReadDeadline(time.Now().Add(timeout))
+					conn.SetReadDeadline(time.Now().Add(timeout))
 					break
 				}
-				return err
+				return nil, err
 			}
 
+			hdr, body, err := parseHeader(data)
+			if err != nil || addr.String() != raddr.String() {
+				continue
+			}
+			// The server refused us: no point in trying again. In any
+			// version, or one that speaks none of ours could not say so
+			if hdr.msgType == msgREJ {
+				var rej handShakeReject
+				if rej.load(s.verifykey, body) != nil || rej.session != s.session {
+					continue
+				}
+				return nil, rej.error()
+			}
+			if !isSupportedVersion(hdr.version) {
+				continue
+			}
+			// The server is under load and wants proof of our address
+			if hdr.msgType == msgHVR {
+				var hv helloVerify
+				if hv.decode(body) != nil || hv.session != s.session {
+					continue
+				}
+				pkg = append(strPkg[:len(strPkg):len(strPkg)], hv.cookie[:]...)
+				_, err = conn.WriteToUDP(pkg, raddr)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
 			// Drop Message
-			if data[0] != ProtocolVer || data[1] != msgSHS {
+			if hdr.msgType != msgSHS {
 				continue
 			}
 			// Drop Message
-			err = hsmsg.load(s.verifykey, data[2:])
-			if err != nil || hsmsg.session != s.session || addr.String() != s.raddr.String() {
+			err = hsmsg.load(s.verifykey, body)
+			if err != nil || hsmsg.session != s.session || hdr.version != hsmsg.version {
+				continue
+			}
+			if (hsmsg.caps&capHybrid != 0) != (len(hsmsg.kem) != 0) {
 				continue
 			}
+			// Signed by the server, so a bad choice is not a forgery
+			err = checkNegotiated(start.versions, start.caps, hsmsg.version, hsmsg.caps)
+			if err != nil {
+				return nil, err
+			}
 			// Clean the Deadline
-			s.conn.SetReadDeadline(time.Time{})
-			success = true
-			break
+			conn.SetReadDeadline(time.Time{})
+			return &helloResult{
+				conn:   conn,
+				raddr:  raddr,
+				hsmsg:  hsmsg,
+				shsPkg: data[:2+hsmsg.size()],
+			}, nil
 		}
 	}
-	if !success {
-		return fmt.Errorf("handshake timeout")
-	}
+	return nil, fmt.Errorf("handshake timeout")
+}
+
+func (s *Socket) handShakeClient(addrs []*net.UDPAddr) error {
+	var (
+		start startHandShake
+		dk    *mlkem.DecapsulationKey768
+		err   error
+	)
 
-	s.encrypt, err = newCipher()
+	start.session = s.session
+	start.timestamp = uint64(time.Now().Unix())
+	copy(start.ip[:], s.ip.To16())
+	start.versions = supportedVersions
+	start.caps = supportedCaps&^capSuites | s.suites
+	if s.hybrid {
+		dk, err = mlkem.GenerateKey768()
+		if err != nil {
+			return err
+		}
+		start.ek = dk.EncapsulationKey().Bytes()
+	} else {
+		start.caps &^= capHybrid
+	}
+	if s.cert != nil {
+		start.cert = s.cert
+	} else {
+		start.caps &^= capCert
+	}
+	// Signed once, so every address races with the very same STR
+	strPkg, err := s.packHandShakeMessage(ProtocolVer, msgSTR, &start)
 	if err != nil {
 		return err
 	}
-
-	err = s.encrypt.SharedSecret(hsmsg.epk[:])
+	res, err := s.race(addrs, &start, strPkg)
 	if err != nil {
 		return err
 	}
+	hsmsg := res.hsmsg
+	shsPkg := res.shsPkg
+	fail := func(err error) error {
+		res.conn.Close()
+		return err
+	}
+
+	// The session is built apart and only takes the place of the old one,
+	// under s.mu, once confirmed, see resume
+	encrypt, err := newCipher()
+	if err != nil {
+		return fail(err)
+	}
+	encrypt.version = hsmsg.version
+	encrypt.session = s.session
+	encrypt.suite = suiteByCap(hsmsg.caps)
+
+	err = encrypt.SharedSecret(hsmsg.epk[:])
+	if err != nil {
+		return fail(err)
+	}
+	if hsmsg.caps&capHybrid != 0 {
+		err = encrypt.decapsulate(dk, hsmsg.kem)
+		if err != nil {
+			return fail(err)
+		}
+	}
 
 	// Store the public key
 	hsmsg.session = s.session
-	copy(hsmsg.epk[:], s.encrypt.PublicKey())
+	copy(hsmsg.epk[:], encrypt.PublicKey())
+	hsmsg.kem = nil
 
-	hsmsg.signature = [64]byte{}
-	pkg, err = s.packHandShakeMessage(msgCHS, &hsmsg)
+	hsmsg.signature = nil
+	pkg, err := s.packHandShakeMessage(encrypt.version, msgCHS, &hsmsg)
 	if err != nil {
-		return err
+		return fail(err)
 	}
-	_, err = s.conn.WriteToUDP(pkg, s.raddr)
-	return err
+	th := transcriptHash(strPkg, shsPkg, pkg)
+	encrypt.psk = s.psk
+	err = encrypt.DeriveKeys(s.session[:], th, true)
+	if err != nil {
+		return fail(err)
+	}
+	err = s.confirm(res, encrypt.version, pkg, th, confirmKeys(encrypt.confirm, th))
+	if err != nil {
+		return fail(err)
+	}
+	// Not before: a hybrid STR, or one with a certificate, is larger than
+	// baseDatagram and may only cross a small path in fragments. What goes
+	// out from now on is sized by path MTU discovery
+	if err = setDontFragment(res.conn); err != nil {
+		return fail(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fail(net.ErrClosed)
+	}
+	s.conn = res.conn
+	s.raddr = res.raddr
+	s.encrypt = encrypt
+	s.version = hsmsg.version
+	s.caps = hsmsg.caps
+	s.frags = reassembly{}
+	s.pmtu.startDiscovery(s.caps, s.maxDatagram)
+	// Kept when the session is resumed
+	if s.channels == nil {
+		s.channels = newChannelSet(s, nil, 1, make(chan *Channel, channelQueue))
+		s.main = s.channels.add(0)
+	}
+	return nil
+}
+
+// confirm sends the CHS until the server acknowledges it with an HSD over
+// the same transcript, so the session is ready on both sides once it returns.
+// An HSD whose MAC is not mac comes from a server with other keys, a
+// different PSK, and fails the handshake.
+func (s *Socket) confirm(res *helloResult, version byte, chsPkg []byte, th []byte, mac []byte) error {
+	var (
+		done handShakeDone
+	)
+	conn, raddr := res.conn, res.raddr
+	timeout := 500 * time.Millisecond
+	for tries := 5; tries > 0; tries-- {
+		_, err := conn.WriteToUDP(chsPkg, raddr)
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			data, addr, err := readFromUDP(conn)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					timeout *= 2
+					break
+				}
+				return err
+			}
+			// Drop Message
+			hdr, body, err := parseHeader(data)
+			if err != nil || hdr.version != version || hdr.msgType != msgHSD || addr.String() != raddr.String() {
+				continue
+			}
+			err = done.load(s.verifykey, body)
+			if err != nil || done.session != s.session || !bytes.Equal(done.transcript[:], th) {
+				continue
+			}
+			if !hmac.Equal(done.mac[:], mac) {
+				return fmt.Errorf("key confirmation failed, check the preshared key")
+			}
+			conn.SetReadDeadline(time.Time{})
+			return nil
+		}
+	}
+	return fmt.Errorf("handshake timeout")
 }
 
+// Write sends data as one packet of the main pipe.
 func (s *Socket) Write(data []byte) (int, error) {
-	var buffer [2048]byte
+	if err := s.send(0, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
 
-	buffer[0] = ProtocolVer
-	buffer[1] = msgDFE
-	tmp, err := dumpDataFrame(s.encrypt, data)
+// send seals a packet with flags for the session and sends it.
+func (s *Socket) send(flags byte, packet []byte) error {
+	var (
+		rekey []byte
+		err   error
+	)
+	s.mu.Lock()
+	if s.resuming {
+		// Dropped, as the network would while the session is down
+		s.mu.Unlock()
+		return nil
+	}
+	encrypt := s.encrypt
+	if encrypt == nil {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	conn, raddr := s.conn, s.raddr
+	caps := s.caps
+	datagram := s.pmtu.size
+	if s.caps&capRekey != 0 {
+		rekey, err = s.rekey.request(s.encrypt, s.rekeyAfter, s.rekeyBytes)
+	}
+	s.mu.Unlock()
 	if err != nil {
-		return 0, err
+		return err
+	}
+	if rekey != nil {
+		_, err = conn.WriteToUDP(rekey, raddr)
+		if err != nil {
+			return err
+		}
 	}
 
-	copy(buffer[2:], tmp)
-	_, err = s.conn.WriteToUDP(buffer[:len(tmp)+2], s.raddr)
-	return len(tmp), err
+	frames, err := sealPacket(encrypt, caps, flags, s.fragID.Add(1), packet, datagram)
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		_, err = conn.WriteToUDP(frame, raddr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// Read returns the next packet of the main pipe, see receive. A packet
+// larger than buffer is dropped, as a TUN drops what passes its MTU, and
+// Read waits for the next one.
 func (s *Socket) Read(buffer []byte) (int, error) {
-
+	s.mu.Lock()
+	main := s.main
+	s.mu.Unlock()
+	if main == nil {
+		return 0, net.ErrClosed
+	}
 	for {
-		n, addr, err := s.conn.ReadFromUDP(buffer[:])
+		p, err := s.receive(main)
 		if err != nil {
 			return 0, err
 		}
+		if len(p) <= len(buffer) {
+			return copy(buffer, p), nil
+		}
+	}
+}
+
+// readPacket reads datagrams until one brings a packet, which it queues
+// for its channel. The caller holds s.reading.
+func (s *Socket) readPacket() error {
+	buffer := s.inbuf[:]
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return err
+		}
 		if addr.String() != s.raddr.String() {
 			continue // Drop
 		}
 
-		if buffer[0] != ProtocolVer || buffer[1] != msgDFE {
+		hdr, body, err := parseHeader(buffer[:n])
+		if err == nil && hdr.msgType == msgUSN && hdr.version == s.version {
+			err = s.handleUnknownSession(body)
+			if err != nil {
+				s.channels.close(err)
+				return err
+			}
+			continue
+		}
+		if err != nil || hdr.version != s.version {
+			continue // Drop
+		}
+		msgType := hdr.msgType
+		rekey := s.caps&capRekey != 0 && (msgType == msgRKQ || msgType == msgRKS)
+		fragment := s.caps&capFragment != 0 && msgType == msgFRG
+		probe := s.caps&capPMTU != 0 && (msgType == msgPRB || msgType == msgPRA)
+		if msgType != msgDFE && msgType != msgCLS && !rekey && !fragment && !probe {
 			continue // Drop
 		}
 
-		tmp, err := loadDataFrame(s.encrypt, buffer[2:n])
+		s.mu.Lock()
+		if s.encrypt == nil {
+			s.mu.Unlock()
+			return net.ErrClosed
+		}
+		var tmp []byte
+		f, err := parseFrame(buffer[:n], s.encrypt.suite.saltSize)
+		if err == nil {
+			s.encrypt, tmp, err = s.rekey.open(s.encrypt, f)
+		}
+		if err == nil && f.msgType == msgCLS {
+			s.release()
+			s.mu.Unlock()
+			s.conn.Close()
+			s.channels.close(io.EOF)
+			return io.EOF
+		}
+		if err == nil && f.msgType == msgFRG {
+			tmp, err = s.frags.add(tmp, time.Now())
+			if err == nil && tmp == nil {
+				s.mu.Unlock()
+				continue // Waiting for more pieces
+			}
+		} else if err == nil && probe {
+			s.handleProbe(f.msgType, tmp, n)
+			s.mu.Unlock()
+			continue
+		} else if err == nil && f.msgType != msgDFE {
+			s.handleRekey(f.msgType, tmp)
+			s.mu.Unlock()
+			continue
+		}
+		s.mu.Unlock()
+		if errors.Is(err, errReplayedFrame) {
+			s.dropped.Add(1)
+			continue // Drop
+		}
 		if err != nil {
-			return 0, err
+			// Forged, corrupted, or sealed with a key we no longer have
+			continue // Drop
+		}
+		// Authenticated with the rest of the header
+		s.deliverPacket(f.flags, tmp)
+		return nil
+	}
+}
+
+// handleRekey processes an RKQ or RKS; the caller holds s.mu.
+func (s *Socket) handleRekey(msgType byte, payload []byte) error {
+	epk, err := decodeRekey(payload)
+	if err != nil {
+		return err
+	}
+	if msgType == msgRKS {
+		next, err := s.rekey.complete(s.encrypt, epk, true)
+		if err != nil {
+			return err
+		}
+		s.encrypt = next
+		return nil
+	}
+	reply, err := s.rekey.answer(s.encrypt, epk, true)
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return nil
+	}
+	_, err = s.conn.WriteToUDP(reply, s.raddr)
+	return err
+}
+
+// Close ends the session: the server is sent an authenticated CLS, then the
+// session keys and the UDP socket are released.
+func (s *Socket) Close() error {
+	s.mu.Lock()
+	encrypt := s.encrypt
+	conn, raddr := s.conn, s.raddr
+	s.release()
+	s.closed = true
+	s.channels.close(net.ErrClosed)
+	s.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	if encrypt != nil {
+		if data, err := packDataFrame(encrypt, msgCLS, nil); err == nil {
+			conn.WriteToUDP(data, raddr)
 		}
-		copy(buffer[0:len(tmp)], tmp)
-		return len(tmp), nil
 	}
+	return conn.Close()
+}
+
+// release forgets the session keys; the caller holds s.mu.
+func (s *Socket) release() {
+	s.encrypt = nil
+	s.rekey = rekeyState{}
+	s.frags = reassembly{}
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// ReplayDropped returns how many frames were discarded by the replay window
+// since the socket connected.
+func (s *Socket) ReplayDropped() uint64 {
+	return s.dropped.Load()
 }
@@ -0,0 +1,86 @@
+package sdtl
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// cipherSuite is the AEAD that seals data frames. All of them have a 16 byte
+// tag and take the frame counter as the tail of the nonce; a suite with a
+// longer nonce fills the head with random salt carried in every frame.
+type cipherSuite struct {
+	capability uint32
+	name       string
+	saltSize   int
+	newAEAD    func(key []byte) (cipher.AEAD, error)
+}
+
+var cipherSuites = []*cipherSuite{
+	{capSuiteAESGCM, "aes-gcm", 0, newGCM},
+	{capSuiteChaCha20, "chacha20-poly1305", 0, chacha20poly1305.New},
+	{capSuiteXChaCha20, "xchacha20-poly1305", 16, chacha20poly1305.NewX},
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, e := aes.NewCipher(key)
+	if e != nil {
+		return nil, e
+	}
+	return cipher.NewGCM(block)
+}
+
+// suiteByCap returns the suite selected in caps, nil when there is none.
+func suiteByCap(caps uint32) *cipherSuite {
+	for _, s := range cipherSuites {
+		if caps&capSuites == s.capability {
+			return s
+		}
+	}
+	return nil
+}
+
+// suitesByName turns suite names, as written in the configuration, into
+// capability bits. No names means every suite.
+func suitesByName(names ...string) (uint32, error) {
+	if len(names) == 0 {
+		return capSuites & supportedCaps, nil
+	}
+	var caps uint32
+	for _, name := range names {
+		found := false
+		for _, s := range cipherSuites {
+			if s.name == name {
+				caps |= s.capability
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown cipher suite: %s", name)
+		}
+	}
+	return caps, nil
+}
+
+// nonce builds the AEAD nonce from the salt and the packet counter. Each
+// direction has its own key, so the counter alone keeps nonces unique.
+func (s *cipherSuite) nonce(size int, salt []byte, counter uint64) []byte {
+	nonce := make([]byte, size)
+	copy(nonce, salt)
+	binary.BigEndian.PutUint64(nonce[size-8:], counter)
+	return nonce
+}
+
+// Frame layout for the suite: version, type, flags, session, counter, salt,
+// tag, ciphertext. The header is all that comes before the tag.
+func (s *cipherSuite) tagOffset() int {
+	return dataFrameSaltOffset + s.saltSize
+}
+
+// headerSize is what a frame takes besides the ciphertext.
+func (s *cipherSuite) headerSize() int {
+	return s.tagOffset() + dataFrameTagSize
+}
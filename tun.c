@@ -24,6 +24,18 @@
 #include <netinet/in.h>
 #include <arpa/inet.h>
 
+#if defined(__APPLE__)
+#include <netinet6/in6_var.h>
+#elif defined(__linux__)
+// Same layout as the kernel's struct in6_ifreq (linux/ipv6.h), which
+// clashes with the libc headers
+struct sdtl_in6_ifreq {
+    struct in6_addr ifr6_addr;
+    unsigned int    ifr6_prefixlen;
+    int             ifr6_ifindex;
+};
+#endif
+
 char *sys_error() {
 	return strerror(errno);
 }
@@ -91,6 +103,86 @@ int configure_interface(const char* iface_name, const char* ip_address, const ch
     return 0;
 }
 
+int configure_interface6(const char* iface_name, const char* ip_address, int prefixlen) {
+    int sockfd;
+
+    if (prefixlen < 0 || prefixlen > 128) {
+        errno = EINVAL;
+        return -1;
+    }
+
+    sockfd = socket(AF_INET6, SOCK_DGRAM, 0);
+    if (sockfd < 0) {
+        return -1;
+    }
+
+#if defined (__linux__)
+    struct ifreq ifr;
+    struct sdtl_in6_ifreq ifr6;
+
+    memset(&ifr, 0, sizeof(ifr));
+    strncpy(ifr.ifr_name, iface_name, IFNAMSIZ);
+    if (ioctl(sockfd, SIOCGIFINDEX, &ifr) < 0) {
+        close(sockfd);
+        return -1;
+    }
+
+    memset(&ifr6, 0, sizeof(ifr6));
+    if (inet_pton(AF_INET6, ip_address, &ifr6.ifr6_addr) != 1) {
+        close(sockfd);
+        errno = EINVAL;
+        return -1;
+    }
+    ifr6.ifr6_prefixlen = prefixlen;
+    ifr6.ifr6_ifindex = ifr.ifr_ifindex;
+    if (ioctl(sockfd, SIOCSIFADDR, &ifr6) < 0) {
+        close(sockfd);
+        return -1;
+    }
+
+    // Levantar la interfaz
+    if (ioctl(sockfd, SIOCGIFFLAGS, &ifr) == 0) {
+        ifr.ifr_flags |= (IFF_UP | IFF_RUNNING);
+        ioctl(sockfd, SIOCSIFFLAGS, &ifr);
+    }
+#elif defined (__APPLE__)
+    struct in6_aliasreq ifra;
+    int i;
+
+    memset(&ifra, 0, sizeof(ifra));
+    strncpy(ifra.ifra_name, iface_name, IFNAMSIZ);
+
+    ifra.ifra_addr.sin6_family = AF_INET6;
+    ifra.ifra_addr.sin6_len = sizeof(struct sockaddr_in6);
+    if (inet_pton(AF_INET6, ip_address, &ifra.ifra_addr.sin6_addr) != 1) {
+        close(sockfd);
+        errno = EINVAL;
+        return -1;
+    }
+
+    // Construir la máscara a partir del largo del prefijo
+    ifra.ifra_prefixmask.sin6_family = AF_INET6;
+    ifra.ifra_prefixmask.sin6_len = sizeof(struct sockaddr_in6);
+    for (i = 0; i < 16; i++) {
+        int bits = prefixlen - i * 8;
+        if (bits >= 8) {
+            ifra.ifra_prefixmask.sin6_addr.s6_addr[i] = 0xff;
+        } else if (bits > 0) {
+            ifra.ifra_prefixmask.sin6_addr.s6_addr[i] = (unsigned char)(0xff << (8 - bits));
+        }
+    }
+
+    ifra.ifra_lifetime.ia6t_vltime = 0xffffffff;
+    ifra.ifra_lifetime.ia6t_pltime = 0xffffffff;
+    if (ioctl(sockfd, SIOCAIFADDR_IN6, &ifra) < 0) {
+        close(sockfd);
+        return -1;
+    }
+#endif
+    close(sockfd);
+    return 0;
+}
+
 #if defined(__APPLE__)
 int open_utun() {
     struct ctl_info ctl_info;
@@ -8,7 +8,9 @@ package sdtl
 import "C"
 import (
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"unsafe"
 )
 
@@ -19,10 +21,30 @@ type Utun struct {
 	MTU  int
 }
 
+// SetIP assigns the overlay address to the interface. For an IPv6 address
+// mask is either a prefix length such as "64" or an IPv6 netmask.
 func (u *Utun) SetIP(ip string, mask string) error {
 	name := C.CString(u.Name)
 	defer func() { C.free(unsafe.Pointer(name)) }()
 
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("setting interface address: invalid address %s", ip)
+	}
+	if parsed.To4() == nil {
+		prefix, e := prefixLength(mask)
+		if e != nil {
+			return fmt.Errorf("setting interface address: %v", e)
+		}
+		csip := C.CString(ip)
+		defer func() { C.free(unsafe.Pointer(csip)) }()
+		ret := C.configure_interface6(name, csip, C.int(prefix))
+		if ret == -1 {
+			return fmt.Errorf("setting interface address: %v", C.GoString(C.sys_error()))
+		}
+		return nil
+	}
+
 	csip := C.CString(ip)
 	defer func() { C.free(unsafe.Pointer(csip)) }()
 	csmask := C.CString(mask)
@@ -34,6 +56,24 @@ func (u *Utun) SetIP(ip string, mask string) error {
 	return nil
 }
 
+func prefixLength(mask string) (int, error) {
+	if n, e := strconv.Atoi(mask); e == nil {
+		if n < 0 || n > 128 {
+			return 0, fmt.Errorf("invalid prefix length %d", n)
+		}
+		return n, nil
+	}
+	ip := net.ParseIP(mask)
+	if ip == nil || ip.To4() != nil {
+		return 0, fmt.Errorf("invalid IPv6 mask %s", mask)
+	}
+	ones, bits := net.IPMask(ip.To16()).Size()
+	if bits == 0 {
+		return 0, fmt.Errorf("non contiguous IPv6 mask %s", mask)
+	}
+	return ones, nil
+}
+
 func (u *Utun) SetMTU(val int) error {
 	name := C.CString(u.Name)
 	defer func() { C.free(unsafe.Pointer(name)) }()
@@ -57,9 +97,11 @@ func (u *Utun) Read(buf []byte) (int, error) {
 	return u.file.Read(buf[:u.MTU])
 }
 
+// Write is bounded by the overlay maximum, not by MTU: lowering the MTU
+// of the interface does not make the peer send smaller packets.
 func (u *Utun) Write(buf []byte) (int, error) {
-	if len(buf) > u.MTU {
-		return 0, fmt.Errorf("invalid buf len, greather than MTU")
+	if len(buf) > maxPacketSize {
+		return 0, fmt.Errorf("invalid buf len, greather than %d", maxPacketSize)
 	}
 	return u.file.Write(buf)
 }
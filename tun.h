@@ -14,5 +14,6 @@ extern int tun_alloc(char *dev);
 
 extern char *sys_error();
 extern int configure_interface(const char* iface_name, const char* ip_address, const char* netmask);
+extern int configure_interface6(const char* iface_name, const char* ip_address, int prefixlen);
 extern int set_mtu(const char *iface_name, int mtu);
 #endif 
\ No newline at end of file